@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	optWorst   int
+	analyzeCmd = &cobra.Command{
+		Use:   "analyze [username] [keyboard]",
+		Short: "Score an existing layout without optimizing it.",
+		Long: `Score a fully specified keyboard layout against the user's corpus and
+penalties without optimizing it. Keys marked as free to place are left empty.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run:  analyze,
+	}
+)
+
+func init() {
+	analyzeCmd.Flags().IntVar(&optWorst, "worst", 5, "Number of worst quartads to show for each rule")
+	rootCmd.AddCommand(analyzeCmd)
+}
+
+// FingerLoad counts the key presses made by each finger of each hand,
+// including presses of modifier keys.
+type FingerLoad struct {
+	Presses    [2][5]int // Indexed by hand (left first) and finger
+	Keypresses int
+	Missing    map[rune]int // Runes typed that are not on the layout
+}
+
+type quartadPenalty struct {
+	Quartad Quartad
+	Penalty float64
+}
+
+func analyze(cmd *cobra.Command, args []string) {
+	username := args[0]
+	if len(args) > 1 {
+		optLayout = args[1]
+	}
+
+	user, err := ReadUser("users/" + username + ".json")
+	if err != nil {
+		p.Println(err)
+		return
+	}
+
+	// Build the quartads without touching the layout so free keys stay empty
+	quartadInfo, err := GetLayoutQuartadList(user.Corpus, user)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+
+	layout := user.Layout
+	runesToKeyPhysicalKeyInfoMap := layout.mapRunesToPhysicalKeyInfo()
+	penaltyRules := InitPenaltyRules(user)
+	total, results := CalculatePenaltyDetailed(quartadInfo.Quartads, layout, runesToKeyPhysicalKeyInfoMap, &penaltyRules)
+
+	p.Println(layout.String())
+	p.Printf("Layout penalty: %d\n", int(total))
+
+	p.Println("\nPenalty by rule:")
+	for _, result := range results {
+		if result.Info.Cost == 0 {
+			continue
+		}
+		share := 0.0
+		if total != 0 {
+			share = result.Total / total * 100.0
+		}
+		p.Printf("%33s: %14d %7.2f%%\n", result.Name, int(result.Total), share)
+	}
+
+	if optWorst > 0 {
+		p.Println("\nWorst quartads by rule:")
+		for _, result := range results {
+			if result.Info.Cost == 0 || result.Total == 0 || len(result.HighKeys) == 0 {
+				continue
+			}
+			p.Printf("%33s:", result.Name)
+			for _, entry := range worstQuartads(result, optWorst) {
+				p.Printf(" %q (%d)", entry.Quartad.String(), int(entry.Penalty))
+			}
+			p.Println()
+		}
+	}
+
+	metrics := CalculateMetrics(layout, quartadInfo.Quartads, runesToKeyPhysicalKeyInfoMap)
+	p.Println("\nMetrics:")
+	printMetrics(metrics)
+}
+
+// worstQuartads returns the quartads contributing the most to a rule, by
+// absolute value so that bonuses from negative costs are shown too.
+func worstQuartads(result KeyPenaltyResult, n int) []quartadPenalty {
+	entries := make([]quartadPenalty, 0, len(result.HighKeys))
+	for quartad, penalty := range result.HighKeys {
+		entries = append(entries, quartadPenalty{Quartad: quartad, Penalty: penalty})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := math.Abs(entries[i].Penalty), math.Abs(entries[j].Penalty)
+		if a != b {
+			return a > b
+		}
+		return entries[i].Quartad.Cmp(entries[j].Quartad) < 0
+	})
+	return entries[:min(n, len(entries))]
+}
+
+// CalculateFingerLoad counts the presses of each finger using the single rune
+// quartads, which occur once for every rune typed.
+func CalculateFingerLoad(layout Layout, quartads QuartadList, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo) FingerLoad {
+	load := FingerLoad{Missing: make(map[rune]int)}
+
+	press := func(keyInfo *KeyPhysicalInfo, count int) {
+		for _, key := range pressedKeys(keyInfo) {
+			hand := 1
+			if layout.isLeftHand(key) {
+				hand = 0
+			}
+			load.Presses[hand][key.associatedFinger] += count
+			load.Keypresses += count
+		}
+	}
+
+	for quartad, count := range quartads {
+		if quartad.Len() != 1 {
+			continue
+		}
+		keyInfo, ok := runesToKeyPhysicalKeyInfoMap[quartad.GetRune(0)]
+		if !ok {
+			load.Missing[quartad.GetRune(0)] += count
+			continue
+		}
+		press(keyInfo, count)
+		if modifier := runesToKeyPhysicalKeyInfoMap[rune(quartad.GetModifier(0))]; modifier != nil {
+			press(modifier, count)
+		}
+		if layerKey := getLayerKey(keyInfo, runesToKeyPhysicalKeyInfoMap); layerKey != nil {
+			press(layerKey, count)
+		}
+	}
+
+	return load
+}
+
+func printFingerLoad(load FingerLoad) {
+	if load.Keypresses == 0 {
+		return
+	}
+	for hand, name := range []string{"Left", "Right"} {
+		handTotal := 0
+		for finger := Thumb; finger <= Pinkie; finger++ {
+			handTotal += load.Presses[hand][finger]
+		}
+		handPercent := float64(handTotal) / float64(load.Keypresses) * 100.0
+		p.Printf("%33s: %s %5.1f%%\n", name+" hand", generateProgressBar(handPercent, 16), handPercent)
+		for finger := Thumb; finger <= Pinkie; finger++ {
+			percent := float64(load.Presses[hand][finger]) / float64(load.Keypresses) * 100.0
+			p.Printf("%33s: %s %5.1f%%\n", finger.String(), generateProgressBar(percent, 16), percent)
+		}
+	}
+
+	if len(load.Missing) > 0 {
+		missing := 0
+		missingRunes := make([]rune, 0, len(load.Missing))
+		for r, count := range load.Missing {
+			missing += count
+			missingRunes = append(missingRunes, RuneDisplayVersion(r))
+		}
+		sort.Slice(missingRunes, func(i, j int) bool { return missingRunes[i] < missingRunes[j] })
+		p.Printf("\nRunes not on the layout: %s (%d keypresses)\n", string(missingRunes), missing)
+	}
+}
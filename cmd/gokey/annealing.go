@@ -2,6 +2,7 @@ package main
 
 import (
 	"math"
+	"math/rand"
 )
 
 // SimulatedAnnealing represents the simulated annealing optimizer
@@ -11,6 +12,8 @@ type SimulatedAnnealing struct {
 	P0 float64
 	N  int
 	KN float64
+
+	rng *rand.Rand
 }
 
 // NewSimulatedAnnealing initializes a simulated annealing optimizer
@@ -25,7 +28,10 @@ type SimulatedAnnealing struct {
 //
 // It's often beneficial to run multiple annealing processes with different
 // parameter sets to find the best results for your specific problem.
-func NewSimulatedAnnealing(iterations int) *SimulatedAnnealing {
+//
+// Each optimizer needs its own rng as math/rand generators are not safe for
+// concurrent use.
+func NewSimulatedAnnealing(iterations int, rng *rand.Rand) *SimulatedAnnealing {
 	sa := &SimulatedAnnealing{
 		// Initial temperature: controls initial acceptance probability of worse solutions
 		// Higher values (5-20) allow more exploration early on
@@ -45,6 +51,8 @@ func NewSimulatedAnnealing(iterations int) *SimulatedAnnealing {
 		// More iterations (100,000-1,000,000) allow for more thorough exploration
 		// Fewer iterations (10,000-100,000) for quicker, less thorough searches
 		N: iterations,
+
+		rng: rng,
 	}
 
 	// Normalized cooling rate: used in temperature calculation
@@ -71,7 +79,7 @@ func (sa *SimulatedAnnealing) AcceptTransition(de float64, i int) bool {
 		return true
 	}
 	pDe := sa.CutoffP(de, i)
-	r := r.Float64()
+	r := sa.rng.Float64()
 	return r < pDe
 }
 
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	corpusCacheFormat  = "gokey-corpus"
+	corpusCacheVersion = 2
+)
+
+var (
+	optCorpusCache string
+	corpusCmd      = &cobra.Command{
+		Use:   "corpus",
+		Short: "Manage the corpus.",
+		Long:  `Manage the corpus files users type.`,
+	}
+	corpusBuildCmd = &cobra.Command{
+		Use:   "build [username]",
+		Short: "Cache the counts of the user's corpus.",
+		Long: `Count the runes and the sequences of up to four runes in the user's corpus
+and save them in the corpus cache. Later runs read the counts from the cache
+rather than the corpus while the corpus files are unchanged.`,
+		Args: cobra.ExactArgs(1),
+		Run:  buildCorpusCache,
+	}
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&optCorpusCache, "corpus-cache", "corpus/cache", "Directory of corpus caches made with corpus build")
+	corpusCmd.AddCommand(corpusBuildCmd)
+	rootCmd.AddCommand(corpusCmd)
+}
+
+// CorpusCache holds how often every sequence of one to four runes appears in
+// a group of corpus files, which is all that's needed to count their runes
+// and quartads for any layout. It is saved as gzipped JSON named by its key,
+// which is a hash of the contents of the files, so a cache is only used while
+// the files are unchanged.
+type CorpusCache struct {
+	Format  string         `json:"format"`
+	Version int            `json:"version"`
+	Key     string         `json:"key"`
+	Files   []FileHash     `json:"files"`
+	Ngrams  map[string]int `json:"ngrams"`
+}
+
+// corpusCacheKey hashes the contents of the files in order with their
+// preprocessors, and where each stream of files starts.
+func corpusCacheKey(group []CorpusSource) (string, []FileHash, error) {
+	streams, err := corpusStreams(group)
+	if err != nil {
+		return "", nil, err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %d\n", corpusCacheFormat, corpusCacheVersion)
+	var files []FileHash
+	for _, stream := range streams {
+		fmt.Fprintf(h, "stream\n")
+		for _, file := range stream {
+			hash, err := hashFile(file.Path)
+			if err != nil {
+				return "", nil, err
+			}
+			files = append(files, hash)
+			fmt.Fprintf(h, "%s %s\n", hash.SHA256, strings.Join(file.Preprocess, ","))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), files, nil
+}
+
+func corpusCacheFilename(key string) string {
+	return filepath.Join(optCorpusCache, key+".json.gz")
+}
+
+// readCorpusCache returns the cache for a group of corpus files, or nil if
+// there isn't an up to date one.
+func readCorpusCache(group []CorpusSource) (*CorpusCache, error) {
+	if _, err := os.Stat(optCorpusCache); err != nil {
+		return nil, nil
+	}
+	key, _, err := corpusCacheKey(group)
+	if err != nil {
+		return nil, err
+	}
+	filename := corpusCacheFilename(key)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading corpus cache %s: %w", filename, err)
+	}
+	var cache CorpusCache
+	if err := json.NewDecoder(zr).Decode(&cache); err != nil {
+		return nil, fmt.Errorf("error reading corpus cache %s: %w", filename, err)
+	}
+	if cache.Format != corpusCacheFormat || cache.Version != corpusCacheVersion {
+		p.Printf("Ignoring corpus cache %s from another version, run corpus build again\n", filename)
+		return nil, nil
+	}
+	if optDebug > 0 {
+		p.Printf("Using corpus cache %s\n", filename)
+	}
+	return &cache, nil
+}
+
+// countRunes calls fn with each rune and how often it appears.
+func (cache *CorpusCache) countRunes(fn func(r rune, count int)) {
+	for ngram, count := range cache.Ngrams {
+		if runes := []rune(ngram); len(runes) == 1 {
+			fn(runes[0], count)
+		}
+	}
+}
+
+// countQuartads adds the sequences made only of runes on the keyboard to the
+// counter's quartads, as scanning the corpus with it would.
+func (cache *CorpusCache) countQuartads(counter *quartadCounter) {
+	for ngram, count := range cache.Ngrams {
+		runes := []rune(ngram)
+		onKeyboard := true
+		for _, r := range runes {
+			onKeyboard = onKeyboard && isValidRune(r, counter.runesOnKeyboard)
+		}
+		if onKeyboard {
+			counter.quartads[quartadOf(runes, counter.shiftedRunes)] += count
+		}
+	}
+}
+
+// buildCorpusCache saves a cache for each group of the user's corpus files.
+func buildCorpusCache(cmd *cobra.Command, args []string) {
+	user, err := ReadUser("users/" + args[0] + ".json")
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	groups, _, err := corpusGroups(user.Corpus)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	if err := os.MkdirAll(optCorpusCache, 0o755); err != nil {
+		p.Println(fmt.Errorf("error creating corpus cache: %w", err))
+		return
+	}
+
+	for _, group := range groups {
+		key, files, err := corpusCacheKey(group)
+		if err != nil {
+			p.Println(err)
+			return
+		}
+
+		// Count every sequence, not just those of runes on a keyboard
+		counter := quartadCounter{quartads: make(QuartadList)}
+		if err := scanCorpus(group, counter.add, counter.split); err != nil {
+			p.Println(err)
+			return
+		}
+		cache := CorpusCache{
+			Format:  corpusCacheFormat,
+			Version: corpusCacheVersion,
+			Key:     key,
+			Files:   files,
+			Ngrams:  make(map[string]int, len(counter.quartads)),
+		}
+		for quartad, count := range counter.quartads {
+			cache.Ngrams[string(quartad.runes[:quartad.length])] += count
+		}
+
+		filename := corpusCacheFilename(key)
+		if err := cache.save(filename); err != nil {
+			p.Println(err)
+			return
+		}
+		p.Printf("Saved %d sequences from %d files to %s\n", len(cache.Ngrams), len(files), filename)
+	}
+}
+
+func (cache *CorpusCache) save(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("error writing corpus cache: %w", err)
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	encoder := json.NewEncoder(zw)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(cache); err != nil {
+		return fmt.Errorf("error writing corpus cache: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error writing corpus cache: %w", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const checkpointVersion = 1
+
+var (
+	// interrupted is set on SIGINT so that the chains can save a checkpoint
+	// and stop cleanly
+	interrupted atomic.Bool
+
+	resumeCmd = &cobra.Command{
+		Use:   "resume [run directory or checkpoint]",
+		Short: "Continue an optimization run from its checkpoints.",
+		Long: `Continue an optimization run from the checkpoints written by an earlier run.
+Given the run's directory, every chain of a parallel run is resumed together
+and the best layout across them is reported. Given a single checkpoint file,
+only that chain is resumed.`,
+		Args: cobra.ExactArgs(1),
+		Run:  resume,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(resumeCmd)
+}
+
+// Checkpoint is the saved state of an annealing chain, along with what is
+// needed to rebuild the quartads and continue on the same schedule.
+type Checkpoint struct {
+	Version         int     `json:"version"`
+	Username        string  `json:"username"`
+	UserFile        string  `json:"user_file"`
+	Keyboard        string  `json:"keyboard"`
+	Seed            int64   `json:"seed"`
+	Chain           int     `json:"chain"`
+	Iterations      int     `json:"iterations"`
+	Swaps           int     `json:"swaps"`
+	CheckpointEvery int     `json:"checkpoint_every"`
+	NextIteration   int     `json:"next_iteration"`
+	Temperature     float64 `json:"temperature"`
+	RngSeed         int64   `json:"rng_seed"`
+	BestPenalty     float64 `json:"best_penalty"`
+	Accepted        []Key   `json:"accepted"`
+	Best            []Key   `json:"best"`
+}
+
+// Checkpointer saves the state of a chain to a file every so many iterations.
+// A nil Checkpointer never saves.
+type Checkpointer struct {
+	Path       string
+	Every      int
+	Checkpoint Checkpoint
+}
+
+// ForChain returns a checkpointer writing to a separate file for one of
+// several parallel chains.
+func (c *Checkpointer) ForChain(chain int) *Checkpointer {
+	if c == nil {
+		return nil
+	}
+	chainCheckpointer := *c
+	ext := filepath.Ext(c.Path)
+	chainCheckpointer.Path = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(c.Path, ext), chain, ext)
+	chainCheckpointer.Checkpoint.Chain = chain
+	return &chainCheckpointer
+}
+
+// Due reports whether a checkpoint should be written before iteration i. No
+// checkpoint is written on the first iteration of a run or a resumed run.
+func (c *Checkpointer) Due(i int, start int) bool {
+	return c != nil && c.Every > 0 && i != start && i%c.Every == 0
+}
+
+// Save writes the chain state to the checkpoint file. The chain's random
+// number generator is reseeded from a fresh seed which is stored in the
+// checkpoint, so a resumed run continues with the same random sequence.
+func (c *Checkpointer) Save(state ChainState, sa *SimulatedAnnealing, rng *rand.Rand) error {
+	if c == nil {
+		return nil
+	}
+
+	checkpoint := c.Checkpoint
+	checkpoint.Version = checkpointVersion
+	checkpoint.CheckpointEvery = c.Every
+	checkpoint.NextIteration = state.NextIteration
+	checkpoint.Temperature = sa.Temperature(state.NextIteration)
+	checkpoint.BestPenalty = state.Best.Penalty
+	checkpoint.Accepted = state.Accepted.keyContents()
+	checkpoint.Best = state.Best.Layout.keyContents()
+	checkpoint.RngSeed = rng.Int63()
+	rng.Seed(checkpoint.RngSeed)
+
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a kill part way through the write
+	// doesn't destroy the previous checkpoint
+	tmp := c.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, c.Path); err != nil {
+		return fmt.Errorf("error writing checkpoint: %w", err)
+	}
+	return nil
+}
+
+func ReadCheckpoint(filename string) (Checkpoint, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return Checkpoint{}, fmt.Errorf("error reading file: %w", err)
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return Checkpoint{}, fmt.Errorf("error parsing JSON: %w", err)
+	}
+	if checkpoint.Version != checkpointVersion {
+		return Checkpoint{}, fmt.Errorf("unsupported checkpoint version %d", checkpoint.Version)
+	}
+
+	return checkpoint, nil
+}
+
+// keyContents returns the contents of every key in allKeys order.
+func (layout *Layout) keyContents() []Key {
+	keyInfos := layout.allKeys()
+	keys := make([]Key, len(keyInfos))
+	for i, keyInfo := range keyInfos {
+		keys[i] = *keyInfo.key
+	}
+	return keys
+}
+
+// setKeyContents replaces the contents of every key with those saved by
+// keyContents.
+func (layout *Layout) setKeyContents(keys []Key) error {
+	keyInfos := layout.allKeys()
+	if len(keys) != len(keyInfos) {
+		return fmt.Errorf("layout has %d keys but %d were saved", len(keyInfos), len(keys))
+	}
+	for i, keyInfo := range keyInfos {
+		*keyInfo.key = keys[i]
+	}
+	return nil
+}
+
+// watchForInterrupt sets the interrupted flag on the first SIGINT. A second
+// SIGINT kills the process as normal.
+func watchForInterrupt() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		interrupted.Store(true)
+		signal.Stop(signals)
+	}()
+}
+
+func reportInterrupted(checkpointer *Checkpointer) {
+	if !interrupted.Load() {
+		return
+	}
+	if checkpointer == nil {
+		p.Println("\nInterrupted")
+		return
+	}
+	p.Printf("\nInterrupted, checkpoints saved in %s\n", filepath.Dir(checkpointer.Path))
+}
+
+func resume(cmd *cobra.Command, args []string) {
+	checkpointFiles, err := findCheckpoints(args[0])
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	checkpoints := make([]Checkpoint, len(checkpointFiles))
+	for i, checkpointFile := range checkpointFiles {
+		checkpoints[i], err = ReadCheckpoint(checkpointFile)
+		if err != nil {
+			p.Printf("%s: %v\n", checkpointFile, err)
+			return
+		}
+		if !checkpoints[i].sameRun(checkpoints[0]) {
+			p.Printf("%s is from a different run than %s\n", checkpointFile, checkpointFiles[0])
+			return
+		}
+	}
+	first := checkpoints[0]
+
+	// Use the original seed and keyboard so the runes are assigned to keys in
+	// the same way and the quartads match the original run
+	r = rand.New(rand.NewSource(first.Seed))
+	optLayout = first.Keyboard
+	user, err := ReadUser(first.UserFile)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	quartadInfo, err := GetQuartadList(user.Corpus, user)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+
+	// Make sure we are continuing on the same annealing schedule
+	sa := NewSimulatedAnnealing(first.Iterations, nil)
+	chains := make([]parallelChain, len(checkpoints))
+	checkpointers := make([]*Checkpointer, len(checkpoints))
+	for i, checkpoint := range checkpoints {
+		if t := sa.Temperature(checkpoint.NextIteration); math.Abs(t-checkpoint.Temperature) > 1e-9*math.Max(1, math.Abs(t)) {
+			p.Printf("%s: checkpoint temperature %g does not match the schedule (%g)\n", checkpointFiles[i], checkpoint.Temperature, t)
+			return
+		}
+		state, err := checkpoint.chainState(user.Layout)
+		if err != nil {
+			p.Printf("%s: %v\n", checkpointFiles[i], err)
+			return
+		}
+		checkpointers[i] = &Checkpointer{Path: checkpointFiles[i], Every: checkpoint.CheckpointEvery, Checkpoint: checkpoint}
+		chains[i] = parallelChain{Number: checkpoint.Chain, Layout: user.Layout, Resume: &state, Status: &chainStatus{}}
+		chains[i].Optimizer = &AnnealingChain{
+			QuartadInfo:  quartadInfo,
+			User:         user,
+			Iterations:   checkpoint.Iterations,
+			NumSwaps:     checkpoint.Swaps,
+			Rng:          rand.New(rand.NewSource(checkpoint.RngSeed)),
+			ShowProgress: len(checkpoints) == 1,
+			Status:       chains[i].Status,
+			Checkpointer: checkpointers[i],
+		}
+	}
+	watchForInterrupt()
+
+	startTime := time.Now()
+	var bestLayout BestLayoutEntry
+	if len(chains) == 1 {
+		p.Printf("Resuming chain %d at iteration %d/%d\n", first.Chain, first.NextIteration, first.Iterations)
+		bestLayout = chains[0].Optimizer.Run(chains[0].Layout, chains[0].Resume)
+	} else {
+		p.Printf("Resuming %d chains of %d iterations\n", len(chains), first.Iterations)
+		results := runChains(startTime, chains, first.Iterations)
+		bestLayout = results[reportChains(chains, results)]
+	}
+
+	printBestLayout(startTime, quartadInfo, user, nil, bestLayout, first.Iterations+1)
+	reportInterrupted(checkpointers[0])
+
+	saveBestLayout(bestLayout, filepath.Dir(checkpointFiles[0]), "")
+}
+
+// findCheckpoints returns the checkpoint given, or every checkpoint of the
+// chains of a run when given its directory.
+func findCheckpoints(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	single := filepath.Join(path, "checkpoint.json")
+	if _, err := os.Stat(single); err == nil {
+		return []string{single}, nil
+	}
+	chains, err := filepath.Glob(filepath.Join(path, "checkpoint-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("no checkpoints in %s", path)
+	}
+	sort.Slice(chains, func(i, j int) bool {
+		return checkpointChain(chains[i]) < checkpointChain(chains[j])
+	})
+	return chains, nil
+}
+
+// checkpointChain returns the chain number in the name of a chain's
+// checkpoint file.
+func checkpointChain(filename string) int {
+	name := strings.TrimSuffix(filepath.Base(filename), ".json")
+	chain, _ := strconv.Atoi(strings.TrimPrefix(name, "checkpoint-"))
+	return chain
+}
+
+// sameRun reports whether two checkpoints are chains of the same run.
+func (c Checkpoint) sameRun(other Checkpoint) bool {
+	return c.UserFile == other.UserFile && c.Keyboard == other.Keyboard && c.Seed == other.Seed &&
+		c.Iterations == other.Iterations && c.Swaps == other.Swaps
+}
+
+// chainState rebuilds the state of the chain from the checkpoint, with the
+// saved key contents placed on copies of the layout.
+func (c Checkpoint) chainState(layout Layout) (ChainState, error) {
+	state := ChainState{
+		NextIteration: c.NextIteration,
+		Accepted:      layout.Duplicate(),
+		Best:          BestLayoutEntry{Layout: layout.Duplicate(), Penalty: c.BestPenalty},
+	}
+	if err := state.Accepted.setKeyContents(c.Accepted); err != nil {
+		return ChainState{}, err
+	}
+	if err := state.Best.Layout.setKeyContents(c.Best); err != nil {
+		return ChainState{}, err
+	}
+	return state, nil
+}
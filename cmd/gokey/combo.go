@@ -0,0 +1,106 @@
+package main
+
+import "fmt"
+
+// Combo is a virtual key typed by pressing several keys of the base layer
+// together. Keys are positions like "L1,3" and Key is written like a key in
+// the rows but without a finger, so "*" leaves the combo free to place.
+type Combo struct {
+	Keys []string `json:"keys"`
+	Key  string   `json:"key"`
+}
+
+// ProcessCombos sets up a key for each combo and returns the number of runes
+// free to place on them. A combo uses the hand and finger of its first key,
+// costs as much as pressing all of its keys and sits where they are on
+// average. It must be called once the costs of the keys are known.
+func (layout *Layout) ProcessCombos(essentialRunes *map[rune]bool, locale Locale) (int, error) {
+	freeToPlaceRunes := 0
+	layout.ComboKeys = make([]KeyPhysicalInfo, len(layout.Combos))
+	for i, combo := range layout.Combos {
+		if len(combo.Keys) < 2 {
+			return 0, fmt.Errorf("combo %d must have at least two keys", i)
+		}
+		keys := make([]*KeyPhysicalInfo, len(combo.Keys))
+		for j, position := range combo.Keys {
+			keyInfo, err := layout.keyAt(position, 0)
+			if err != nil {
+				return 0, fmt.Errorf("combo %d: %w", i, err)
+			}
+			for _, other := range keys[:j] {
+				if samePhysicalKey(keyInfo, other) {
+					return 0, fmt.Errorf("combo %d uses %s more than once", i, position)
+				}
+			}
+			keys[j] = keyInfo
+		}
+
+		// Combos are numbered by negative rows so they are never the same
+		// physical key as anything else
+		first := keys[0]
+		keyStr := combo.Key + string(fingerChar(first.associatedFinger))
+		keyInfo, err := layout.parseKeyString(first.hand, -1-i, -1, keyStr, essentialRunes, layout.SupportsOverrides, locale)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing combo %d: %v", i, err)
+		}
+		keyInfo.combo = keys
+		keyInfo.vertDeltaToHome, keyInfo.horzDeltaToHome = first.vertDeltaToHome, first.horzDeltaToHome
+		for _, key := range keys {
+			n := float64(len(keys))
+			keyInfo.cost += key.cost
+			keyInfo.x += key.x / n
+			keyInfo.y += key.y / n
+			keyInfo.xToHome += key.xToHome / n
+			keyInfo.yToHome += key.yToHome / n
+		}
+
+		if keyInfo.key.UnshiftedIsFree {
+			freeToPlaceRunes++
+		}
+		if keyInfo.key.ShiftedIsFree {
+			freeToPlaceRunes++
+		}
+		layout.ComboKeys[i] = keyInfo
+	}
+	return freeToPlaceRunes, nil
+}
+
+// isCombo reports whether a key is typed by a combo.
+func isCombo(keyInfo *KeyPhysicalInfo) bool {
+	return len(keyInfo.combo) > 0
+}
+
+// pressedKeys returns the physical keys pressed to type a key, which are the
+// keys of a combo or the key itself.
+func pressedKeys(keyInfo *KeyPhysicalInfo) []*KeyPhysicalInfo {
+	if isCombo(keyInfo) {
+		return keyInfo.combo
+	}
+	return []*KeyPhysicalInfo{keyInfo}
+}
+
+// comboFingers counts the fingers needed to press a combo.
+func comboFingers(keyInfo *KeyPhysicalInfo) int {
+	type handFinger struct {
+		hand   *Side
+		finger Finger
+	}
+	fingers := make(map[handFinger]bool)
+	for _, key := range keyInfo.combo {
+		fingers[handFinger{key.hand, key.associatedFinger}] = true
+	}
+	return len(fingers)
+}
+
+// comboPositions returns the positions of a combo's keys, like "L1,3".
+func (layout *Layout) comboPositions(keyInfo *KeyPhysicalInfo) []string {
+	positions := make([]string, len(keyInfo.combo))
+	for i, key := range keyInfo.combo {
+		side := "R"
+		if layout.isLeftHand(key) {
+			side = "L"
+		}
+		positions[i] = fmt.Sprintf("%s%d,%d", side, key.row, key.col)
+	}
+	return positions
+}
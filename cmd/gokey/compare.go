@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/spf13/cobra"
+)
+
+var (
+	optFormat  string
+	compareCmd = &cobra.Command{
+		Use:   "compare [username] [keyboard...]",
+		Short: "Compare the penalties of several existing layouts.",
+		Long: `Score several fully specified keyboard layouts against the user's corpus
+and show them ranked by total penalty. Keypresses of runes a layout is missing
+add a large penalty, so layouts that can type the whole corpus rank first.`,
+		Args: cobra.MinimumNArgs(2),
+		Run:  compare,
+	}
+)
+
+func init() {
+	compareCmd.Flags().StringVarP(&optFormat, "format", "f", "table", "Output format (table, csv or json)")
+	rootCmd.AddCommand(compareCmd)
+}
+
+// LayoutScore is the penalty breakdown of one layout in a comparison.
+type LayoutScore struct {
+	Rank              int         `json:"rank"`
+	Keyboard          string      `json:"keyboard"`
+	Name              string      `json:"name"`
+	Total             float64     `json:"total"`
+	Rules             []RuleScore `json:"rules"`
+	MissingKeypresses int         `json:"missing_keypresses"`
+	Metrics           []RuleScore `json:"metrics"`
+	Usage             []RuleScore `json:"usage"`
+}
+
+// RuleScore is the total of one penalty rule, or the percentage for a metric
+// or the keypresses made by a hand or finger.
+type RuleScore struct {
+	Name  string  `json:"name"`
+	Total float64 `json:"total"`
+}
+
+func compare(cmd *cobra.Command, args []string) {
+	username := args[0]
+	keyboards := args[1:]
+
+	user, err := ReadUser("users/" + username + ".json")
+	if err != nil {
+		p.Println(err)
+		return
+	}
+
+	// Every layout is scored on the same corpus, counted once
+	foundRunes, blend, err := countRunes(user.Corpus, user)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+
+	scores := make([]LayoutScore, 0, len(keyboards))
+	for _, keyboard := range keyboards {
+		score, err := scoreKeyboard(user, keyboard, blend, foundRunes)
+		if err != nil {
+			p.Printf("%s: %v\n", keyboard, err)
+			return
+		}
+		scores = append(scores, score)
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].Total < scores[j].Total
+	})
+	for i := range scores {
+		scores[i].Rank = i + 1
+	}
+
+	switch optFormat {
+	case "table":
+		printComparisonTable(scores)
+	case "csv":
+		err = writeComparisonCSV(scores)
+	case "json":
+		err = writeComparisonJSON(scores)
+	default:
+		err = fmt.Errorf("unknown format %q", optFormat)
+	}
+	if err != nil {
+		p.Println(err)
+	}
+}
+
+// scoreKeyboard loads a keyboard with the user's finger costs and scores it on
+// its quartads, built as they are for the user's own layout.
+func scoreKeyboard(user User, keyboard string, blend corpusBlend, foundRunes map[rune]int) (LayoutScore, error) {
+	user.Keyboard = keyboard
+	layout, err := ReadLayout(user)
+	if err != nil {
+		return LayoutScore{}, err
+	}
+	quartadInfo, err := layoutQuartadInfo(blend, foundRunes, layout, user)
+	if err != nil {
+		return LayoutScore{}, err
+	}
+
+	runesToKeyPhysicalKeyInfoMap := layout.mapRunesToPhysicalKeyInfo()
+	penaltyRules := InitPenaltyRules(user)
+	total, results := CalculatePenaltyDetailed(quartadInfo.Quartads, layout, runesToKeyPhysicalKeyInfoMap, &penaltyRules)
+	metrics := CalculateMetrics(layout, quartadInfo.Quartads, runesToKeyPhysicalKeyInfoMap)
+
+	score := LayoutScore{
+		Keyboard: keyboard,
+		Name:     layout.Name,
+		Total:    total,
+	}
+	for _, result := range results {
+		if result.Info.Cost != 0 {
+			score.Rules = append(score.Rules, RuleScore{Name: result.Name, Total: result.Total})
+		}
+	}
+	for _, m := range metrics.List() {
+		score.Metrics = append(score.Metrics, RuleScore{Name: m.Name, Total: m.Percent()})
+	}
+	for _, count := range metrics.Load.Missing {
+		score.MissingKeypresses += count
+	}
+	score.Usage = usageScores(metrics.Load)
+
+	return score, nil
+}
+
+// usageScores returns the percentage of the keypresses made by each hand,
+// followed by each of its fingers.
+func usageScores(load FingerLoad) []RuleScore {
+	percent := func(presses int) float64 {
+		if load.Keypresses == 0 {
+			return 0
+		}
+		return float64(presses) / float64(load.Keypresses) * 100.0
+	}
+
+	var usage []RuleScore
+	for hand, name := range []string{"Left", "Right"} {
+		handTotal := 0
+		for finger := Thumb; finger <= Pinkie; finger++ {
+			handTotal += load.Presses[hand][finger]
+		}
+		usage = append(usage, RuleScore{Name: name + " hand", Total: percent(handTotal)})
+		for finger := Thumb; finger <= Pinkie; finger++ {
+			usage = append(usage, RuleScore{Name: name + " " + strings.ToLower(finger.String()), Total: percent(load.Presses[hand][finger])})
+		}
+	}
+	return usage
+}
+
+// printComparisonTable shows the layouts as columns, best first, with a row
+// for the total and each rule.
+func printComparisonTable(scores []LayoutScore) {
+	if len(scores) == 0 {
+		return
+	}
+	headerStyle := lipgloss.NewStyle().Foreground(lipgloss.Color(blue))
+	bestStyle := lipgloss.NewStyle().Foreground(lipgloss.Color(green))
+	titles := make([]string, len(scores))
+	width := 14
+	for i, score := range scores {
+		titles[i] = p.Sprintf("%d. %s", score.Rank, strings.TrimSuffix(filepath.Base(score.Keyboard), ".json"))
+		width = max(width, len([]rune(titles[i]))+2)
+	}
+	cell := func(s string) string {
+		return lipgloss.NewStyle().Width(width).Align(lipgloss.Right).Render(s)
+	}
+
+	header := p.Sprintf("%33s ", "")
+	for _, title := range titles {
+		header += cell(title)
+	}
+	p.Println(headerStyle.Render(header))
+
+	printRow := func(name string, values []float64) {
+		row := p.Sprintf("%33s:", name)
+		best := 0
+		for i, value := range values {
+			if value < values[best] {
+				best = i
+			}
+		}
+		for i, value := range values {
+			text := cell(p.Sprintf("%d", int(value)))
+			if i == best && len(values) > 1 {
+				text = bestStyle.Render(text)
+			}
+			row += text
+		}
+		p.Println(row)
+	}
+
+	totals := make([]float64, len(scores))
+	for i, score := range scores {
+		totals[i] = score.Total
+	}
+	printRow("Total", totals)
+	for r, rule := range scores[0].Rules {
+		values := make([]float64, len(scores))
+		for i, score := range scores {
+			values[i] = score.Rules[r].Total
+		}
+		printRow(rule.Name, values)
+	}
+	missing := make([]float64, len(scores))
+	for i, score := range scores {
+		missing[i] = float64(score.MissingKeypresses)
+	}
+	printRow("Missing keypresses", missing)
+
+	// Metrics aren't all better when lower so none are highlighted
+	p.Println()
+	for m, metric := range scores[0].Metrics {
+		row := p.Sprintf("%33s:", metric.Name)
+		for _, score := range scores {
+			row += cell(p.Sprintf("%.2f%%", score.Metrics[m].Total))
+		}
+		p.Println(row)
+	}
+
+	// Nor is the share of the keypresses each hand and finger makes
+	p.Println()
+	for u, usage := range scores[0].Usage {
+		row := p.Sprintf("%33s:", usage.Name)
+		for _, score := range scores {
+			row += cell(p.Sprintf("%.1f%%", score.Usage[u].Total))
+		}
+		p.Println(row)
+	}
+}
+
+func writeComparisonCSV(scores []LayoutScore) error {
+	w := csv.NewWriter(os.Stdout)
+	header := []string{"rank", "keyboard", "name", "total"}
+	if len(scores) > 0 {
+		for _, rule := range scores[0].Rules {
+			header = append(header, rule.Name)
+		}
+	}
+	header = append(header, "missing_keypresses")
+	if len(scores) > 0 {
+		for _, metric := range scores[0].Metrics {
+			header = append(header, metric.Name+" %")
+		}
+		for _, usage := range scores[0].Usage {
+			header = append(header, usage.Name+" %")
+		}
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, score := range scores {
+		record := []string{fmt.Sprint(score.Rank), score.Keyboard, score.Name, formatFloat(score.Total)}
+		for _, rule := range score.Rules {
+			record = append(record, formatFloat(rule.Total))
+		}
+		record = append(record, fmt.Sprint(score.MissingKeypresses))
+		for _, metric := range score.Metrics {
+			record = append(record, formatFloat(metric.Total))
+		}
+		for _, usage := range score.Usage {
+			record = append(record, formatFloat(usage.Total))
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func writeComparisonJSON(scores []LayoutScore) error {
+	data, err := json.MarshalIndent(scores, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(data))
+	return err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	PinConstraint      = "pin"       // A rune is on the key at Position
+	RowConstraint      = "row"       // Runes are on Row, on Side if given
+	AdjacentConstraint = "adjacent"  // Runes are next to each other in one row, in order
+	SameHandConstraint = "same_hand" // Runes are on the same hand
+)
+
+// Constraint limits where the user's runes can go. Constraints without a
+// weight are hard and the optimizer never breaks them. Constraints with a
+// weight are soft and add the weight to the penalty for each rune out of
+// place. All constraints are on the base layer.
+type Constraint struct {
+	Type     string  `json:"type"`
+	Runes    string  `json:"runes"`
+	Position string  `json:"position,omitempty"`
+	Side     string  `json:"side,omitempty"` // "left" or "right"
+	Row      int     `json:"row,omitempty"`
+	Weight   float64 `json:"weight,omitempty"`
+	runes    []rune
+	pinLeft  bool
+	pinRow   int
+	pinCol   int
+}
+
+// validateConstraints checks the user's constraints make sense for the layout.
+func (layout *Layout) validateConstraints(constraints []Constraint) error {
+	for i := range constraints {
+		c := &constraints[i]
+		c.runes = nil
+		for _, r := range c.Runes {
+			c.runes = append(c.runes, r)
+		}
+		if len(c.runes) == 0 {
+			return fmt.Errorf("constraint %d has no runes", i)
+		}
+		if c.Weight < 0 {
+			return fmt.Errorf("constraint %d has a negative weight", i)
+		}
+		if c.Side != "" && c.Side != "left" && c.Side != "right" {
+			return fmt.Errorf("constraint %d has unknown side %q", i, c.Side)
+		}
+
+		switch c.Type {
+		case PinConstraint:
+			if len(c.runes) != 1 {
+				return fmt.Errorf("constraint %d must pin one rune", i)
+			}
+			if _, err := layout.keyAt(c.Position, 0); err != nil {
+				return fmt.Errorf("constraint %d: %w", i, err)
+			}
+			match := positionPattern.FindStringSubmatch(c.Position)
+			c.pinLeft = match[1] == "L"
+			c.pinRow, _ = strconv.Atoi(match[2])
+			c.pinCol, _ = strconv.Atoi(match[3])
+		case RowConstraint:
+			for _, side := range layout.constraintSides(c) {
+				if c.Row < 0 || c.Row >= len(side.Rows) {
+					return fmt.Errorf("constraint %d has row %d which isn't on the keyboard", i, c.Row)
+				}
+			}
+		case AdjacentConstraint, SameHandConstraint:
+			if len(c.runes) < 2 {
+				return fmt.Errorf("constraint %d needs at least two runes", i)
+			}
+		default:
+			return fmt.Errorf("constraint %d has unknown type %q", i, c.Type)
+		}
+	}
+	return nil
+}
+
+func (c Constraint) String() string {
+	switch c.Type {
+	case PinConstraint:
+		return fmt.Sprintf("pin %s to %s", c.Runes, c.Position)
+	case RowConstraint:
+		if c.Side != "" {
+			return fmt.Sprintf("%s on %s row %d", c.Runes, c.Side, c.Row)
+		}
+		return fmt.Sprintf("%s on row %d", c.Runes, c.Row)
+	case AdjacentConstraint:
+		return fmt.Sprintf("%s adjacent", c.Runes)
+	default:
+		return fmt.Sprintf("%s on one hand", c.Runes)
+	}
+}
+
+// constraintSides returns the sides a row constraint can be met on.
+func (layout *Layout) constraintSides(c *Constraint) []*Side {
+	switch c.Side {
+	case "left":
+		return []*Side{&layout.Left}
+	case "right":
+		return []*Side{&layout.Right}
+	default:
+		return []*Side{&layout.Left, &layout.Right}
+	}
+}
+
+// constraintViolations counts the runes that are out of place for a
+// constraint. Runes missing from the layout are always out of place.
+func (layout *Layout) constraintViolations(c *Constraint, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo) int {
+	keys := make([]*KeyPhysicalInfo, len(c.runes))
+	violations := 0
+	for i, r := range c.runes {
+		keys[i] = runesToKeyPhysicalKeyInfoMap[r]
+		if keys[i] == nil || keys[i].layer != 0 || isCombo(keys[i]) {
+			keys[i] = nil
+			violations++
+		}
+	}
+
+	switch c.Type {
+	case PinConstraint:
+		if keys[0] != nil && (keys[0].row != c.pinRow || keys[0].col != c.pinCol || layout.isLeftHand(keys[0]) != c.pinLeft) {
+			violations++
+		}
+	case RowConstraint:
+		for _, keyInfo := range keys {
+			if keyInfo != nil && !layout.inConstraintRow(c, keyInfo) {
+				violations++
+			}
+		}
+	case AdjacentConstraint:
+		for i := 1; i < len(keys); i++ {
+			prev, curr := keys[i-1], keys[i]
+			if prev != nil && curr != nil && (curr.hand != prev.hand || curr.row != prev.row || curr.col != prev.col+1) {
+				violations++
+			}
+		}
+	case SameHandConstraint:
+		left, right := 0, 0
+		for _, keyInfo := range keys {
+			if keyInfo == nil {
+				continue
+			}
+			if layout.isLeftHand(keyInfo) {
+				left++
+			} else {
+				right++
+			}
+		}
+		violations += min(left, right)
+	}
+	return violations
+}
+
+func (layout *Layout) inConstraintRow(c *Constraint, keyInfo *KeyPhysicalInfo) bool {
+	if keyInfo.row != c.Row {
+		return false
+	}
+	return c.Side == "" || (c.Side == "left") == layout.isLeftHand(keyInfo)
+}
+
+// hasHardConstraints reports whether the layout has any hard constraints.
+func (layout *Layout) hasHardConstraints() bool {
+	for _, c := range layout.Constraints {
+		if c.Weight == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// meetsHardConstraints reports whether the layout breaks none of its hard
+// constraints.
+func (layout *Layout) meetsHardConstraints(runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo) bool {
+	for i := range layout.Constraints {
+		c := &layout.Constraints[i]
+		if c.Weight == 0 && layout.constraintViolations(c, runesToKeyPhysicalKeyInfoMap) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// constraintPenaltyRules returns a layout penalty rule for each soft
+// constraint.
+func constraintPenaltyRules(constraints []Constraint) []KeyPenalty {
+	var rules []KeyPenalty
+	for i := range constraints {
+		c := &constraints[i]
+		if c.Weight == 0 {
+			continue
+		}
+		rules = append(rules, KeyPenalty{
+			Name: "Constraint " + c.String(),
+			LayoutFunction: func(layout *Layout, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, cost float64) float64 {
+				return float64(layout.constraintViolations(c, runesToKeyPhysicalKeyInfoMap)) * cost
+			},
+			Cost: c.Weight,
+		})
+	}
+	return rules
+}
+
+// ApplyConstraints moves runes so the layout meets its hard constraints. Each
+// constraint is met in turn by swapping runes onto free keys, and the keys it
+// uses are then left alone while the following constraints are met.
+func (layout *Layout) ApplyConstraints() error {
+	locked := make(map[*Key]bool)
+	for i := range layout.Constraints {
+		c := &layout.Constraints[i]
+		if c.Weight != 0 {
+			continue
+		}
+
+		keyMap := layout.mapRunesToPhysicalKeyInfo()
+		for _, r := range c.runes {
+			if keyMap[r] == nil {
+				return fmt.Errorf("can't meet constraint %s as %c isn't on the layout", c, RuneDisplayVersion(r))
+			}
+		}
+
+		targets := layout.constraintTargets(c, keyMap, locked)
+		for j, target := range targets {
+			if target == nil {
+				continue
+			}
+			current := layout.mapRunesToPhysicalKeyInfo()[c.runes[j]]
+			if current.key != target.key {
+				if !current.swappable || !target.swappable || locked[target.key] {
+					return fmt.Errorf("can't meet constraint %s", c)
+				}
+				swapKeys(current.key, target.key)
+			}
+		}
+
+		keyMap = layout.mapRunesToPhysicalKeyInfo()
+		if layout.constraintViolations(c, keyMap) > 0 {
+			return fmt.Errorf("can't meet constraint %s", c)
+		}
+		for _, r := range c.runes {
+			locked[keyMap[r].key] = true
+		}
+	}
+
+	if !layout.meetsHardConstraints(layout.mapRunesToPhysicalKeyInfo()) {
+		return fmt.Errorf("can't meet all of the constraints together")
+	}
+	return nil
+}
+
+// constraintTargets chooses the key each rune of a constraint should move to,
+// or nil where the rune can stay where it is.
+func (layout *Layout) constraintTargets(c *Constraint, keyMap map[rune]*KeyPhysicalInfo, locked map[*Key]bool) []*KeyPhysicalInfo {
+	targets := make([]*KeyPhysicalInfo, len(c.runes))
+	inConstraint := make(map[*Key]bool)
+	for _, r := range c.runes {
+		inConstraint[keyMap[r].key] = true
+	}
+	available := func(keyInfo *KeyPhysicalInfo) bool {
+		return keyInfo.swappable && !locked[keyInfo.key] && !inConstraint[keyInfo.key]
+	}
+
+	switch c.Type {
+	case PinConstraint:
+		targets[0], _ = layout.keyAt(c.Position, 0)
+	case RowConstraint:
+		var free []*KeyPhysicalInfo
+		for _, side := range layout.constraintSides(c) {
+			for col := range side.Rows[c.Row] {
+				if keyInfo := &side.Rows[c.Row][col]; available(keyInfo) {
+					free = append(free, keyInfo)
+				}
+			}
+		}
+		sortKeysByCost(free)
+		for i, r := range c.runes {
+			if !layout.inConstraintRow(c, keyMap[r]) && len(free) > 0 {
+				targets[i], free = free[0], free[1:]
+			}
+		}
+	case AdjacentConstraint:
+		// Use the run of keys that already has the most runes in place
+		best := -1
+		for _, side := range []*Side{&layout.Left, &layout.Right} {
+			for r, row := range side.Rows {
+				for start := 0; start+len(c.runes) <= len(row); start++ {
+					inPlace := 0
+					for i, rn := range c.runes {
+						keyInfo := &side.Rows[r][start+i]
+						if keyInfo.key == keyMap[rn].key {
+							inPlace++
+						} else if !keyInfo.swappable || locked[keyInfo.key] {
+							inPlace = -1
+							break
+						}
+					}
+					if inPlace > best {
+						best = inPlace
+						for i := range c.runes {
+							targets[i] = &side.Rows[r][start+i]
+						}
+					}
+				}
+			}
+		}
+	case SameHandConstraint:
+		left := 0
+		for _, r := range c.runes {
+			if layout.isLeftHand(keyMap[r]) {
+				left++
+			}
+		}
+		onLeft := left*2 >= len(c.runes)
+		side := &layout.Right
+		if onLeft {
+			side = &layout.Left
+		}
+		var free []*KeyPhysicalInfo
+		for r := range side.Rows {
+			for col := range side.Rows[r] {
+				if keyInfo := &side.Rows[r][col]; available(keyInfo) {
+					free = append(free, keyInfo)
+				}
+			}
+		}
+		sortKeysByCost(free)
+		for i, r := range c.runes {
+			if (layout.isLeftHand(keyMap[r]) != onLeft || keyMap[r].layer != 0) && len(free) > 0 {
+				targets[i], free = free[0], free[1:]
+			}
+		}
+	}
+	return targets
+}
+
+func sortKeysByCost(keyInfos []*KeyPhysicalInfo) {
+	sort.SliceStable(keyInfos, func(i, j int) bool { return keyInfos[i].cost < keyInfos[j].cost })
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// corpusChunkSize is how much of the corpus is read at a time.
+const corpusChunkSize = 1 << 20
+
+// corpusReader reads the corpus files one after another as if they were a
+// single file, opening each only when the one before it is finished. Each
+// file is read through its preprocessors.
+type corpusReader struct {
+	files   []corpusFile
+	file    *os.File
+	current io.Reader
+}
+
+func (c *corpusReader) Read(buf []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.files) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(c.files[0].Path)
+			if err != nil {
+				return 0, fmt.Errorf("error reading file: %w", err)
+			}
+			c.file, c.current = f, preprocess(f, c.files[0])
+			c.files = c.files[1:]
+			if c.current == nil {
+				c.Close()
+				continue
+			}
+		}
+
+		n, err := c.current.Read(buf)
+		if err == io.EOF {
+			c.Close()
+			if n == 0 {
+				continue
+			}
+			err = nil
+		} else if err != nil {
+			err = fmt.Errorf("error reading file: %w", err)
+		}
+		return n, err
+	}
+}
+
+func (c *corpusReader) Close() {
+	if c.file != nil {
+		c.file.Close()
+		c.file, c.current = nil, nil
+	}
+}
+
+// scanCorpus calls fn with each rune of the corpus files in order, and split
+// if it isn't nil at the end of each stream of files. The files are read in
+// chunks, so the corpus never needs to fit in memory, and the files of a
+// stream are decoded as though they were joined into one string.
+func scanCorpus(referenceTextFiles []CorpusSource, fn func(r rune), split func()) error {
+	streams, err := corpusStreams(referenceTextFiles)
+	if err != nil {
+		return err
+	}
+	for _, stream := range streams {
+		if err := scanStream(stream, fn); err != nil {
+			return err
+		}
+		if split != nil {
+			split()
+		}
+	}
+	return nil
+}
+
+func scanStream(files []corpusFile, fn func(r rune)) error {
+	reader := &corpusReader{files: files}
+	defer reader.Close()
+
+	buffered := bufio.NewReaderSize(reader, corpusChunkSize)
+	for {
+		r, _, err := buffered.ReadRune()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(r)
+	}
+}
+
+// quartadCounter counts the quartads of a stream of runes, remembering the
+// last three runes on the keyboard so that quartads span chunks and files.
+// Without runesOnKeyboard every rune is counted.
+type quartadCounter struct {
+	quartads        QuartadList
+	runesOnKeyboard map[rune]int
+	shiftedRunes    map[rune]int
+	recent          [4]rune
+	n               int
+}
+
+// split starts a new stream, so no quartad spans the runes before and after.
+func (c *quartadCounter) split() {
+	c.n = 0
+}
+
+// add counts every quartad of runes on the keyboard that ends with r.
+func (c *quartadCounter) add(r rune) {
+	if c.runesOnKeyboard != nil && !isValidRune(r, c.runesOnKeyboard) {
+		c.n = 0
+		return
+	}
+	if c.n == len(c.recent) {
+		copy(c.recent[:], c.recent[1:])
+		c.n--
+	}
+	c.recent[c.n] = r
+	c.n++
+	for k := 1; k <= c.n; k++ {
+		c.quartads[quartadOf(c.recent[c.n-k:c.n], c.shiftedRunes)]++
+	}
+}
+
+// CorpusSource is a corpus file, directory or glob pattern in the user's
+// profile. It can be given as just its path, or as an object with a weight or
+// a share to control how much of the blended corpus it makes up, the
+// extensions of the files to read from a directory or pattern and the
+// preprocessors to read them through.
+type CorpusSource struct {
+	Path       string   `json:"path"`
+	Weight     float64  `json:"weight"`     // Relative to the other files without a share
+	Share      float64  `json:"share"`      // Percentage of all keystrokes
+	Include    []string `json:"include"`    // Extensions to read, or all if empty
+	Exclude    []string `json:"exclude"`    // Extensions to skip
+	Preprocess []string `json:"preprocess"` // Preprocessors to apply, in order
+}
+
+func (source *CorpusSource) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*source = CorpusSource{Path: path}
+		return nil
+	}
+
+	type rawSource CorpusSource
+	var raw rawSource
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("corpus entries must be a path or an object with a path: %w", err)
+	}
+	*source = CorpusSource(raw)
+	return nil
+}
+
+// corpusGroups splits the corpus into groups whose counts are blended, with
+// the share of keystrokes each group makes up. Without any weights or shares
+// the files are read as one group, as if joined together.
+func corpusGroups(sources []CorpusSource) ([][]CorpusSource, []float64, error) {
+	weighted := false
+	for _, source := range sources {
+		if source.Path == "" {
+			return nil, nil, fmt.Errorf("corpus entries need a path")
+		}
+		if source.Weight < 0 || source.Share < 0 || source.Share > 100 {
+			return nil, nil, fmt.Errorf("corpus %s: weights must be positive and shares between 0 and 100", source.Path)
+		}
+		if source.Weight > 0 && source.Share > 0 {
+			return nil, nil, fmt.Errorf("corpus %s: give a weight or a share, not both", source.Path)
+		}
+		if err := validatePreprocessors(source.Preprocess); err != nil {
+			return nil, nil, fmt.Errorf("corpus %s: %w", source.Path, err)
+		}
+		weighted = weighted || source.Weight > 0 || source.Share > 0
+	}
+	if !weighted {
+		return [][]CorpusSource{sources}, []float64{1.0}, nil
+	}
+
+	// Files with a share get it and the others split what is left by weight
+	rest, weights := 100.0, 0.0
+	for _, source := range sources {
+		rest -= source.Share
+		if source.Share == 0 {
+			weights += sourceWeight(source)
+		}
+	}
+	if rest < -1e-9 || (weights == 0 && math.Abs(rest) > 1e-9) {
+		return nil, nil, fmt.Errorf("corpus shares add up to %g%%, not 100%%", 100-rest)
+	}
+	if weights > 0 && rest < 1e-9 {
+		for _, source := range sources {
+			if source.Share == 0 {
+				return nil, nil, fmt.Errorf("corpus shares add up to 100%%, leaving no share for %s", source.Path)
+			}
+		}
+	}
+
+	groups := make([][]CorpusSource, len(sources))
+	shares := make([]float64, len(sources))
+	for i, source := range sources {
+		groups[i] = []CorpusSource{source}
+		shares[i] = source.Share / 100
+		if source.Share == 0 {
+			shares[i] = max(rest, 0) / 100 * sourceWeight(source) / weights
+		}
+	}
+	return groups, shares, nil
+}
+
+func sourceWeight(source CorpusSource) float64 {
+	if source.Weight == 0 {
+		return 1.0
+	}
+	return source.Weight
+}
+
+// corpusBlend is how the corpus files are grouped and what each group's
+// counts are multiplied by to give it its share of the keystrokes. Groups
+// with a cache are counted from it instead of being read.
+type corpusBlend struct {
+	groups [][]CorpusSource
+	scales []float64
+	caches []*CorpusCache
+}
+
+// newCorpusBlend scales each group so it makes up its share of all the
+// keystrokes in the corpus, leaving the total as it was.
+func newCorpusBlend(groups [][]CorpusSource, shares []float64, keystrokes []int) (corpusBlend, error) {
+	total := 0
+	for _, count := range keystrokes {
+		total += count
+	}
+	blend := corpusBlend{groups: groups, scales: make([]float64, len(groups))}
+	for g := range groups {
+		if keystrokes[g] == 0 {
+			if shares[g] > 0 && len(groups) > 1 {
+				return corpusBlend{}, fmt.Errorf("corpus %s has nothing to type", groups[g][0].Path)
+			}
+			continue
+		}
+		blend.scales[g] = shares[g] * float64(total) / float64(keystrokes[g])
+	}
+	return blend, nil
+}
@@ -91,35 +91,50 @@ func (layout *Layout) stringInternal(costs bool) string {
 	layoutName := layoutNameStyle.Render(p.Sprintf("Layout: %s", layout.Name))
 	sb.WriteString(layoutName + "\n\n")
 
-	// Determine the maximum number of rows
-	maxRows := len(layout.Left.Rows)
-	if len(layout.Right.Rows) > maxRows {
-		maxRows = len(layout.Right.Rows)
-	}
-
 	// Determine the width of the left side
 	leftWidth := 30
 	if costs {
 		leftWidth = 42
 	}
 
-	// Generate the layout visualization
-	for i := 0; i < maxRows; i++ {
-		leftRow := ""
-		rightRow := ""
-
-		if i < len(layout.Left.Rows) {
-			leftRow = visualizeRow(layout.Left.Rows[i], costs)
-		}
-		if i < len(layout.Right.Rows) {
-			rightRow = visualizeRow(layout.Right.Rows[i], costs)
+	// Generate the layout visualization, one layer after another
+	for layer := 0; layer <= len(layout.Layers); layer++ {
+		leftRows := layout.Left.layers()[layer]
+		rightRows := layout.Right.layers()[layer]
+		if layer > 0 {
+			info := layout.Layers[layer-1]
+			sb.WriteString("\n" + layoutNameStyle.Render(p.Sprintf("Layer %c %s (%s)", RuneDisplayVersion(layerRune(layer)), info.Name, info.Activation)) + "\n\n")
 		}
 
-		// Right-align the left row and left-align the right row
-		leftAligned := lipgloss.NewStyle().Width(leftWidth).Align(lipgloss.Right).Render(leftRow)
-		rightAligned := lipgloss.NewStyle().Render(rightRow)
+		// Determine the maximum number of rows
+		maxRows := max(len(leftRows), len(rightRows))
 
-		sb.WriteString(p.Sprintf("%s  |  %s\n", leftAligned, rightAligned))
+		for i := 0; i < maxRows; i++ {
+			leftRow := ""
+			rightRow := ""
+
+			if i < len(leftRows) {
+				leftRow = visualizeRow(leftRows[i], costs)
+			}
+			if i < len(rightRows) {
+				rightRow = visualizeRow(rightRows[i], costs)
+			}
+
+			// Right-align the left row and left-align the right row
+			leftAligned := lipgloss.NewStyle().Width(leftWidth).Align(lipgloss.Right).Render(leftRow)
+			rightAligned := lipgloss.NewStyle().Render(rightRow)
+
+			sb.WriteString(p.Sprintf("%s  |  %s\n", leftAligned, rightAligned))
+		}
+	}
+
+	// List the combos with the keys that are pressed for them
+	if len(layout.ComboKeys) > 0 {
+		sb.WriteString("\n" + layoutNameStyle.Render("Combos") + "\n\n")
+		for i := range layout.ComboKeys {
+			keyInfo := &layout.ComboKeys[i]
+			sb.WriteString(p.Sprintf("%s %s\n", visualizeRow([]KeyPhysicalInfo{*keyInfo}, costs), strings.Join(layout.comboPositions(keyInfo), " + ")))
+		}
 	}
 
 	return sb.String()
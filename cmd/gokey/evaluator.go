@@ -0,0 +1,251 @@
+package main
+
+import "math/rand"
+
+// resumInterval is how many commits the evaluator makes between summing the
+// quartad penalties afresh, which stops rounding errors from the incremental
+// updates building up over a long run.
+const resumInterval = 1000
+
+// Evaluator scores the layouts an annealing chain tries. Swaps are journalled
+// until Commit or Revert is called.
+type Evaluator interface {
+	Layout() *Layout
+	Shuffle(rng *rand.Rand, numSwaps int)
+	Score() float64
+	Commit()
+	Revert()
+	Results() (float64, []KeyPenaltyResult)
+}
+
+// PenaltyEvaluator scores a layout against a quartad list and caches the
+// penalty of every quartad. It knows which quartads contain each rune, so after
+// keys are swapped only the affected quartads need to be rescored.
+//
+// Swaps are journalled until Commit or Revert is called, which lets the
+// optimizer try a candidate layout and throw it away without a full rescore.
+type PenaltyEvaluator struct {
+	layout    *Layout
+	source    QuartadList
+	penalties *[]KeyPenalty
+
+	quartads  []Quartad
+	counts    []int
+	scores    []float64
+	runeIndex map[rune][]int
+	keyInfos  map[*Key]*KeyPhysicalInfo
+	keyMap    map[rune]*KeyPhysicalInfo
+	swappable []*Key
+	total     float64
+	commits   int
+
+	// State for the changes made since the last Commit or Revert
+	committedTotal float64
+	swaps          [][2]*Key
+	journal        []scoreChange
+	dirty          []int
+	touched        []uint32
+	pending        []uint32
+	generation     uint32
+	pass           uint32
+}
+
+type scoreChange struct {
+	index int
+	score float64
+}
+
+// NewPenaltyEvaluator builds the rune index for the quartads and scores the
+// layout in full. The evaluator takes ownership of the layout and mutates it
+// as keys are swapped.
+func NewPenaltyEvaluator(quartads QuartadList, layout *Layout, penalties *[]KeyPenalty) *PenaltyEvaluator {
+	e := &PenaltyEvaluator{
+		layout:    layout,
+		source:    quartads,
+		penalties: penalties,
+		quartads:  make([]Quartad, 0, len(quartads)),
+		counts:    make([]int, 0, len(quartads)),
+		runeIndex: make(map[rune][]int),
+		keyInfos:  make(map[*Key]*KeyPhysicalInfo),
+		keyMap:    layout.mapRunesToPhysicalKeyInfo(),
+		swappable: layout.GetSwappableKeys(),
+	}
+
+	// Keep the quartads in a fixed order so that the floating point sum of the
+	// penalties is the same from run to run
+	for _, entry := range SortQuartadsMapByKeyDesc(quartads) {
+		e.quartads = append(e.quartads, entry.Key)
+		e.counts = append(e.counts, entry.Value)
+	}
+
+	// Index each quartad by every rune it uses, including its modifiers
+	for i, quartad := range e.quartads {
+		seen := make(map[rune]bool, 8)
+		for j := 0; j < quartad.Len(); j++ {
+			seen[quartad.GetRune(j)] = true
+			if m := quartad.GetModifier(j); m != NoModifier {
+				seen[rune(m)] = true
+			}
+		}
+		for r := range seen {
+			e.runeIndex[r] = append(e.runeIndex[r], i)
+		}
+	}
+
+	for _, keyInfo := range layout.allKeys() {
+		e.keyInfos[keyInfo.key] = keyInfo
+	}
+
+	e.scores = make([]float64, len(e.quartads))
+	e.touched = make([]uint32, len(e.quartads))
+	e.pending = make([]uint32, len(e.quartads))
+	e.generation = 1
+	e.pass = 1
+
+	for i, quartad := range e.quartads {
+		e.scores[i] = scoreQuartad(quartad, e.counts[i], e.keyMap, *e.penalties)
+	}
+	e.resum()
+	e.committedTotal = e.total
+
+	return e
+}
+
+// Layout returns the layout being evaluated, including any uncommitted swaps.
+func (e *PenaltyEvaluator) Layout() *Layout {
+	return e.layout
+}
+
+// Shuffle performs a number of random swaps of the swappable keys. Swaps that
+// would break a hard constraint are skipped.
+func (e *PenaltyEvaluator) Shuffle(rng *rand.Rand, numSwaps int) {
+	if len(e.swappable) < 2 {
+		return
+	}
+	constrained := e.layout.hasHardConstraints()
+	for i := 0; i < numSwaps; i++ {
+		a, b := randomKeyPair(rng, e.swappable)
+		if constrained && !e.meetsHardConstraints(a, b) {
+			continue
+		}
+		e.Swap(a, b)
+	}
+}
+
+// meetsHardConstraints reports whether swapping two keys keeps the layout
+// within its hard constraints.
+func (e *PenaltyEvaluator) meetsHardConstraints(a, b *Key) bool {
+	swapKeys(a, b)
+	e.updateKeyMap(a)
+	e.updateKeyMap(b)
+	ok := e.layout.meetsHardConstraints(e.keyMap)
+	swapKeys(a, b)
+	e.updateKeyMap(a)
+	e.updateKeyMap(b)
+	return ok
+}
+
+// Swap exchanges the contents of two keys and marks every quartad using a rune
+// on either key for rescoring.
+func (e *PenaltyEvaluator) Swap(a, b *Key) {
+	swapKeys(a, b)
+	e.swaps = append(e.swaps, [2]*Key{a, b})
+	e.updateKeyMap(a)
+	e.updateKeyMap(b)
+	e.markKey(a)
+	e.markKey(b)
+}
+
+// Score rescores the quartads affected by swaps since the last call and
+// returns the total penalty of the layout, including the penalties that score
+// the whole layout.
+func (e *PenaltyEvaluator) Score() float64 {
+	for _, i := range e.dirty {
+		score := scoreQuartad(e.quartads[i], e.counts[i], e.keyMap, *e.penalties)
+		e.total += score - e.scores[i]
+		e.scores[i] = score
+	}
+	e.dirty = e.dirty[:0]
+	e.pass++
+	return e.total + scoreLayout(e.layout, e.keyMap, *e.penalties)
+}
+
+// Commit accepts the swaps made since the last Commit or Revert.
+func (e *PenaltyEvaluator) Commit() {
+	e.Score()
+	e.commits++
+	if e.commits%resumInterval == 0 {
+		e.resum()
+	}
+	e.committedTotal = e.total
+	e.swaps = e.swaps[:0]
+	e.journal = e.journal[:0]
+	e.generation++
+}
+
+// Revert undoes the swaps made since the last Commit or Revert and restores
+// the cached scores.
+func (e *PenaltyEvaluator) Revert() {
+	for i := len(e.swaps) - 1; i >= 0; i-- {
+		a, b := e.swaps[i][0], e.swaps[i][1]
+		swapKeys(a, b)
+		e.updateKeyMap(a)
+		e.updateKeyMap(b)
+	}
+	for _, change := range e.journal {
+		e.scores[change.index] = change.score
+	}
+	e.total = e.committedTotal
+	e.swaps = e.swaps[:0]
+	e.journal = e.journal[:0]
+	e.dirty = e.dirty[:0]
+	e.generation++
+	e.pass++
+}
+
+// Results runs a full CalculatePenalty over the current layout to get the
+// per-rule breakdown.
+func (e *PenaltyEvaluator) Results() (float64, []KeyPenaltyResult) {
+	return CalculatePenalty(e.source, *e.layout, e.keyMap, e.penalties)
+}
+
+// resum sets the total to the sum of the cached quartad penalties, added in
+// their fixed order.
+func (e *PenaltyEvaluator) resum() {
+	e.total = 0
+	for _, score := range e.scores {
+		e.total += score
+	}
+}
+
+func (e *PenaltyEvaluator) updateKeyMap(key *Key) {
+	keyInfo := e.keyInfos[key]
+	if !key.UnshiftedIsFree {
+		e.keyMap[key.UnshiftedRune] = keyInfo
+	}
+	if !key.ShiftedIsFree {
+		e.keyMap[key.ShiftedRune] = keyInfo
+	}
+}
+
+func (e *PenaltyEvaluator) markKey(key *Key) {
+	if !key.UnshiftedIsFree {
+		e.markRune(key.UnshiftedRune)
+	}
+	if !key.ShiftedIsFree && key.ShiftedRune != key.UnshiftedRune {
+		e.markRune(key.ShiftedRune)
+	}
+}
+
+func (e *PenaltyEvaluator) markRune(r rune) {
+	for _, i := range e.runeIndex[r] {
+		if e.touched[i] != e.generation {
+			e.touched[i] = e.generation
+			e.journal = append(e.journal, scoreChange{index: i, score: e.scores[i]})
+		}
+		if e.pending[i] != e.pass {
+			e.pending[i] = e.pass
+			e.dirty = append(e.dirty, i)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestEvaluatorTotalMatchesCalculatePenalty(t *testing.T) {
+	user := readTestUser(t, "zsa-voyager")
+	quartadInfo, err := PrepareQuartadList(user.Corpus, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := InitPenaltyRules(user)
+	layout := user.Layout
+	evaluator := NewPenaltyEvaluator(quartadInfo.Quartads, &layout, &rules)
+
+	want := func() float64 {
+		total, _ := CalculatePenalty(quartadInfo.Quartads, *evaluator.Layout(), evaluator.Layout().mapRunesToPhysicalKeyInfo(), &rules)
+		return total
+	}
+	check := func(step int, what string, got float64) {
+		t.Helper()
+		if expected := want(); math.Abs(got-expected) > 1e-9*expected {
+			t.Fatalf("step %d: %s total %f, CalculatePenalty gives %f", step, what, got, expected)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	// Enough commits to sum the penalties afresh more than once
+	for step := 0; step < 3*resumInterval; step++ {
+		evaluator.Shuffle(rng, 1+rng.Intn(3))
+		check(step, "swapped", evaluator.Score())
+		if rng.Intn(3) == 0 {
+			evaluator.Revert()
+			check(step, "reverted", evaluator.Score())
+		} else {
+			evaluator.Commit()
+			check(step, "committed", evaluator.Score())
+		}
+	}
+}
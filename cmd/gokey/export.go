@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	optOutput string
+	exportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export a layout as keyboard firmware source.",
+		Long:  `Export a fully specified keyboard layout as keyboard firmware source.`,
+	}
+)
+
+func init() {
+	exportCmd.PersistentFlags().StringVarP(&optOutput, "output", "o", "", "File to write to (defaults to standard output)")
+	rootCmd.AddCommand(exportCmd)
+}
+
+// readExportLayout reads the user and the layout to export, which is the
+// user's keyboard unless another is named.
+func readExportLayout(args []string) (User, error) {
+	if len(args) > 1 {
+		optLayout = args[1]
+	}
+	return ReadUser("users/" + args[0] + ".json")
+}
+
+// writeExport writes exported firmware source to the output file or standard
+// output.
+func writeExport(source string) error {
+	if optOutput == "" {
+		_, err := fmt.Print(source)
+		return err
+	}
+	if err := os.WriteFile(optOutput, []byte(source), 0o644); err != nil {
+		return fmt.Errorf("error writing export: %w", err)
+	}
+	return nil
+}
+
+// firmwareKeys converts rows of key positions like "L2,3" into rows of
+// firmware keycodes for one layer. Entries that aren't positions are firmware
+// keycodes for keys gokey doesn't model and are copied as they are on the base
+// layer. Other layers use the transparent keycode for them and for positions
+// the layer doesn't have a key at.
+func (layout *Layout) firmwareKeys(positions [][]string, layer int, transparent string, keycode func(*KeyPhysicalInfo) (string, error)) ([][]string, error) {
+	rows := make([][]string, len(positions))
+	for r, row := range positions {
+		for _, entry := range row {
+			if !isPosition(entry) {
+				if layer > 0 {
+					entry = transparent
+				}
+				rows[r] = append(rows[r], entry)
+				continue
+			}
+			keyInfo, err := layout.keyAt(entry, layer)
+			if err != nil {
+				if layer > 0 {
+					rows[r] = append(rows[r], transparent)
+					continue
+				}
+				return nil, err
+			}
+			code, err := keycode(keyInfo)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", entry, err)
+			}
+			rows[r] = append(rows[r], code)
+		}
+	}
+	return rows, nil
+}
+
+// formatKeyRows lays out keys in aligned columns, one row per line, with a
+// separator after every key but the last.
+func formatKeyRows(rows [][]string, indent string, separator string) string {
+	width := 0
+	for _, row := range rows {
+		for _, entry := range row {
+			width = max(width, len(entry)+len(separator))
+		}
+	}
+
+	var sb strings.Builder
+	for r, row := range rows {
+		sb.WriteString(indent)
+		for c, entry := range row {
+			last := r == len(rows)-1 && c == len(row)-1
+			if !last {
+				entry += separator
+			}
+			if c == len(row)-1 {
+				sb.WriteString(entry)
+			} else {
+				sb.WriteString(fmt.Sprintf("%-*s ", width, entry))
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"atomicgo.dev/cursor"
+)
+
+const (
+	AnnealingAlgorithm = "sa" // Simulated annealing
+	GeneticAlgorithm   = "ga" // Genetic algorithm
+)
+
+const (
+	geneticTournamentSize = 3   // Layouts compared to pick each parent
+	geneticElites         = 2   // Best layouts copied unchanged to the next generation
+	geneticCrossoverRate  = 0.8 // Chance a child is bred from two parents rather than copied from one
+)
+
+// Optimizer searches for the best layout it can find from a starting layout.
+// Passing a state continues a search from that point, if the optimizer
+// supports it.
+type Optimizer interface {
+	Run(layout Layout, resume *ChainState) BestLayoutEntry
+}
+
+// newOptimizer returns the optimizer chosen with --algorithm, using the
+// settings of the chain.
+func newOptimizer(chain *AnnealingChain) Optimizer {
+	if optAlgorithm == GeneticAlgorithm {
+		return &GeneticSearch{AnnealingChain: *chain, Population: optPopulation}
+	}
+	return chain
+}
+
+// GeneticSearch evolves a population of layouts. Each child is bred from two
+// parents picked by tournament, using an order crossover of the contents of
+// the swappable keys so that fixed keys stay where they are and shifted pairs
+// stay together, and is then mutated by shuffling a few positions. Iterations
+// counts the children scored, so the number of generations is the iterations
+// divided by the population.
+type GeneticSearch struct {
+	AnnealingChain
+	Population int
+}
+
+// genome is the contents of a layout's swappable keys, in order.
+type genome []Key
+
+type individual struct {
+	genome  genome
+	penalty float64
+}
+
+// Run evolves the population from the layout and its shuffles. Resuming isn't
+// supported so the state is ignored.
+func (search *GeneticSearch) Run(layout Layout, resume *ChainState) BestLayoutEntry {
+	startTime := time.Now()
+	user := search.User
+	rng := search.Rng
+	population := max(search.Population, geneticElites+1)
+	generations := max(1, search.Iterations/population)
+	end := generations*population + 1
+
+	// The evaluator is moved to each child in turn to score it, so only the
+	// quartads on keys that differ from the last child are rescored
+	penaltyRules := InitPenaltyRules(user)
+	evaluatorLayout := layout.Duplicate()
+	evaluator := NewPenaltyEvaluator(search.QuartadInfo.Quartads, &evaluatorLayout, &penaltyRules)
+	scratch := layout.Duplicate()
+	scratchKeys := scratch.GetSwappableKeys()
+
+	outputRows := strings.Count(layout.String(), "\n") + 6
+	if optDebug > 1 {
+		outputRows += len(penaltyRules) + 1
+	}
+
+	var best BestLayoutEntry
+	scored := false
+	score := func(g genome) float64 {
+		evaluator.moveTo(g)
+		penalty := evaluator.Score()
+		evaluator.Commit()
+		if !scored || penalty < best.Penalty {
+			scored = true
+			best = BestLayoutEntry{Layout: evaluator.Layout().Duplicate(), Penalty: penalty}
+		}
+		return penalty
+	}
+
+	// Start from the layout and shuffles of it
+	individuals := make([]individual, population)
+	for i := range individuals {
+		setGenome(scratchKeys, genomeOf(layout.GetSwappableKeys()))
+		if i > 0 {
+			scratch.Shuffle(rng, len(scratchKeys))
+		}
+		g := genomeOf(scratchKeys)
+		individuals[i] = individual{genome: g, penalty: score(g)}
+	}
+	sortIndividuals(individuals)
+
+	var results []KeyPenaltyResult
+	if search.ShowProgress {
+		_, results = CalculatePenalty(search.QuartadInfo.Quartads, best.Layout, best.Layout.mapRunesToPhysicalKeyInfo(), &penaltyRules)
+		PrintProgress(startTime, 0, end, best.Layout, best.Penalty, user.StartingPenaltyWatermark, results, &best)
+	}
+
+	for generation := 1; generation <= generations; generation++ {
+		if interrupted.Load() {
+			return best
+		}
+
+		// The best layouts survive and the rest of the next generation are
+		// their children
+		next := make([]individual, 0, population)
+		next = append(next, individuals[:geneticElites]...)
+		for len(next) < population {
+			parent := tournament(rng, individuals)
+			child := append(genome(nil), parent.genome...)
+			if rng.Float64() < geneticCrossoverRate {
+				other := tournament(rng, individuals)
+				setGenome(scratchKeys, orderCrossover(rng, parent.genome, other.genome))
+				if !scratch.hasHardConstraints() || scratch.meetsHardConstraints(scratch.mapRunesToPhysicalKeyInfo()) {
+					child = genomeOf(scratchKeys)
+				}
+			}
+
+			// Mutate the child as annealing shuffles a layout
+			setGenome(scratchKeys, child)
+			for swaps := rng.Intn(search.NumSwaps) + 1; swaps > 0; swaps-- {
+				scratch.shufflePosition(rng, scratchKeys)
+			}
+			child = genomeOf(scratchKeys)
+			next = append(next, individual{genome: child, penalty: score(child)})
+		}
+		individuals = next
+		sortIndividuals(individuals)
+
+		i := generation * population
+		search.Status.update(i, best.Penalty)
+		if search.ShowProgress {
+			if optDebug > 0 {
+				_, results = CalculatePenalty(search.QuartadInfo.Quartads, best.Layout, best.Layout.mapRunesToPhysicalKeyInfo(), &penaltyRules)
+			}
+			cursor.StartOfLineUp(outputRows)
+			PrintProgress(startTime, i, end, best.Layout, individuals[0].penalty, user.StartingPenaltyWatermark, results, &best)
+		}
+	}
+
+	return best
+}
+
+// tournament picks the best of a few individuals chosen at random.
+func tournament(rng *rand.Rand, individuals []individual) individual {
+	winner := individuals[rng.Intn(len(individuals))]
+	for i := 1; i < geneticTournamentSize; i++ {
+		if challenger := individuals[rng.Intn(len(individuals))]; challenger.penalty < winner.penalty {
+			winner = challenger
+		}
+	}
+	return winner
+}
+
+// orderCrossover copies a random slice of the first parent into the child and
+// fills the rest of the keys in the order they appear in the second parent.
+// Both parents hold the same key contents, so the child does too.
+func orderCrossover(rng *rand.Rand, first, second genome) genome {
+	n := len(first)
+	child := make(genome, n)
+	a, b := rng.Intn(n), rng.Intn(n)
+	if a > b {
+		a, b = b, a
+	}
+
+	// Free keys can have the same contents, so count what the slice uses
+	used := make(map[Key]int)
+	for i := a; i <= b; i++ {
+		child[i] = first[i]
+		used[first[i]]++
+	}
+	pos := (b + 1) % n
+	for i := 0; i < n; i++ {
+		key := second[(b+1+i)%n]
+		if used[key] > 0 {
+			used[key]--
+			continue
+		}
+		child[pos] = key
+		pos = (pos + 1) % n
+	}
+	return child
+}
+
+func sortIndividuals(individuals []individual) {
+	sort.SliceStable(individuals, func(i, j int) bool {
+		return individuals[i].penalty < individuals[j].penalty
+	})
+}
+
+func genomeOf(keys []*Key) genome {
+	g := make(genome, len(keys))
+	for i, key := range keys {
+		g[i] = *key
+	}
+	return g
+}
+
+func setGenome(keys []*Key, g genome) {
+	for i, key := range keys {
+		*key = g[i]
+	}
+}
+
+// moveTo swaps keys until the swappable keys hold the genome.
+func (e *PenaltyEvaluator) moveTo(g genome) {
+	for i, key := range e.swappable {
+		if *key == g[i] {
+			continue
+		}
+		for j := i + 1; j < len(e.swappable); j++ {
+			if *e.swappable[j] == g[i] {
+				e.Swap(key, e.swappable[j])
+				break
+			}
+		}
+	}
+}
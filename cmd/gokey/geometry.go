@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// keyUnitMM is the width of a standard key, one key unit, in millimetres
+	keyUnitMM = 19.05
+
+	// geometryTolerance allows for rounding when comparing distances in key
+	// units, such as positions converted from millimetres
+	geometryTolerance = 0.01
+)
+
+// Geometry gives the physical position of every key on a side of the base
+// layer. X and Y have a value for each key in Rows, with y increasing towards
+// the bottom of the keyboard. Splay rotates each column, given in degrees for
+// each column index, about its key in the index finger's home row. Positive
+// angles tilt the top of a column away from the middle of the keyboard.
+// Thumb keys aren't splayed.
+//
+// Without a geometry keys sit on a grid one key unit apart, at their row and
+// column.
+type Geometry struct {
+	Units string      `json:"units,omitempty"` // "u" (key units, the default) or "mm"
+	X     [][]float64 `json:"x"`
+	Y     [][]float64 `json:"y"`
+	Splay []float64   `json:"splay,omitempty"`
+}
+
+// ProcessGeometry sets the position of every key on the side in key units.
+func (s *Side) ProcessGeometry(isLeft bool) error {
+	g := s.Geometry
+	if g == nil {
+		for r := range s.Rows {
+			for c := range s.Rows[r] {
+				s.Rows[r][c].x, s.Rows[r][c].y = float64(c), float64(r)
+			}
+		}
+		return nil
+	}
+
+	scale := 1.0
+	switch g.Units {
+	case "", "u":
+	case "mm":
+		scale = 1.0 / keyUnitMM
+	default:
+		return fmt.Errorf("unknown geometry units %q", g.Units)
+	}
+
+	if len(g.X) != len(s.Rows) || len(g.Y) != len(s.Rows) {
+		return fmt.Errorf("geometry must have x and y for each of the %d rows", len(s.Rows))
+	}
+	for r := range s.Rows {
+		if len(g.X[r]) != len(s.Rows[r]) || len(g.Y[r]) != len(s.Rows[r]) {
+			return fmt.Errorf("geometry must have x and y for each of the %d keys in row %d", len(s.Rows[r]), r)
+		}
+		for c := range s.Rows[r] {
+			s.Rows[r][c].x, s.Rows[r][c].y = g.X[r][c]*scale, g.Y[r][c]*scale
+		}
+	}
+
+	// Splay every column about its home row key, using the unsplayed
+	// position of the pivot for every key in the column
+	pivotRow := s.IndexHome.Row
+	for c, degrees := range g.Splay {
+		if degrees == 0 || pivotRow >= len(s.Rows) || c >= len(s.Rows[pivotRow]) {
+			continue
+		}
+		pivot := s.Rows[pivotRow][c]
+		angle := degrees * math.Pi / 180.0
+		sin, cos := math.Sin(angle), math.Cos(angle)
+		if !isLeft {
+			sin = -sin
+		}
+		for r := range s.Rows {
+			if c >= len(s.Rows[r]) || s.Rows[r][c].associatedFinger == Thumb {
+				continue
+			}
+			keyInfo := &s.Rows[r][c]
+			dx, dy := keyInfo.x-pivot.x, keyInfo.y-pivot.y
+			keyInfo.x = pivot.x + dx*cos + dy*sin
+			keyInfo.y = pivot.y - dx*sin + dy*cos
+		}
+	}
+
+	return nil
+}
+
+// position returns where a key is on the side, or the grid position if there
+// is no key there.
+func (s *Side) position(home HomePosition) (float64, float64) {
+	if home.Row < len(s.Rows) && home.Col < len(s.Rows[home.Row]) {
+		keyInfo := s.Rows[home.Row][home.Col]
+		return keyInfo.x, keyInfo.y
+	}
+	return float64(home.Col), float64(home.Row)
+}
+
+// keyDistance is the distance between two keys in key units.
+func keyDistance(a, b *KeyPhysicalInfo) float64 {
+	return math.Hypot(a.x-b.x, a.y-b.y)
+}
+
+// verticalDistance is the distance between the rows of two keys in key units.
+func verticalDistance(a, b *KeyPhysicalInfo) float64 {
+	return math.Abs(a.y - b.y)
+}
+
+// rowFromHome returns -1 for a key above its finger's home row, 1 for a key
+// below it and 0 for a key in it. Keys less than half a key unit above or
+// below the home key, like those of a neighbouring staggered column, are in
+// the home row.
+func rowFromHome(keyInfo *KeyPhysicalInfo) int {
+	switch {
+	case keyInfo.yToHome <= -0.5:
+		return -1
+	case keyInfo.yToHome >= 0.5:
+		return 1
+	}
+	return 0
+}
+
+// awayFromHome reports whether a key is half a key unit or more from its
+// finger's home key in either direction.
+func awayFromHome(keyInfo *KeyPhysicalInfo) bool {
+	return math.Abs(keyInfo.xToHome) >= 0.5 || math.Abs(keyInfo.yToHome) >= 0.5
+}
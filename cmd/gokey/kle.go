@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	optSplit     float64
+	importKLECmd = &cobra.Command{
+		Use:   "import-kle [kle.json] [keyboard]",
+		Short: "Create a keyboard file from Keyboard Layout Editor JSON.",
+		Long: `Create keyboards/<keyboard>.json from the raw data or downloaded JSON of a
+Keyboard Layout Editor design. Key positions, sizes and rotations become the
+keyboard's geometry. Keys left of the split line belong to the left hand and
+the rest to the right hand. Finger assignments and home positions are guessed
+and every key is left free to place, so check and edit the file before using
+it.`,
+		Args: cobra.ExactArgs(2),
+		Run:  importKLE,
+	}
+)
+
+func init() {
+	importKLECmd.Flags().Float64Var(&optSplit, "split", 0, "X position in key units that separates the hands (defaults to the middle of the keyboard)")
+	rootCmd.AddCommand(importKLECmd)
+}
+
+// kleKey is the position of a key's centre in key units after rotation.
+type kleKey struct {
+	x, y float64
+}
+
+// kleProperties are the KLE key properties that affect where keys are. They
+// apply to the next key in the row, except for the rotation and the position
+// which carry on to the following keys.
+type kleProperties struct {
+	X     float64  `json:"x"`
+	Y     float64  `json:"y"`
+	W     float64  `json:"w"`
+	H     float64  `json:"h"`
+	R     *float64 `json:"r"`
+	RX    *float64 `json:"rx"`
+	RY    *float64 `json:"ry"`
+	Decal bool     `json:"d"`
+}
+
+func importKLE(cmd *cobra.Command, args []string) {
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		p.Println(fmt.Errorf("error reading file: %w", err))
+		return
+	}
+	name, keys, err := parseKLE(data)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	if name == "" {
+		name = args[1]
+	}
+
+	split := optSplit
+	if !cmd.Flags().Changed("split") {
+		split = kleMiddle(keys)
+	}
+	layout, err := kleLayout(name, keys, split)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+
+	filename := keyboardFilename(args[1])
+	if _, err := os.Stat(filename); err == nil {
+		p.Printf("%s already exists\n", filename)
+		return
+	}
+	data, err = json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	if err := os.WriteFile(filename, compactJSON(data), 0o644); err != nil {
+		p.Println(fmt.Errorf("error writing layout: %w", err))
+		return
+	}
+	p.Printf("Saved %d keys to %s\n", len(keys), filename)
+}
+
+// parseKLE reads the keyboard name and the keys of a KLE design, following
+// the way KLE lays out keys. Each row starts one unit below the previous one,
+// back at the x of the rotation origin.
+func parseKLE(data []byte) (string, []kleKey, error) {
+	var rows []json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		// KLE's raw data has unquoted property names and no outer brackets
+		relaxed := append(append([]byte("["), relaxedKLE(data)...), ']')
+		if err := json.Unmarshal(relaxed, &rows); err != nil {
+			return "", nil, fmt.Errorf("error parsing KLE JSON: %w", err)
+		}
+		if len(rows) == 1 && bytes.HasPrefix(bytes.TrimLeft(rows[0][1:], " \t\r\n"), []byte("[")) {
+			if err := json.Unmarshal(rows[0], &rows); err != nil {
+				return "", nil, fmt.Errorf("error parsing KLE JSON: %w", err)
+			}
+		}
+	}
+
+	var name string
+	var keys []kleKey
+	var x, y, r, rx, ry float64
+	for i, raw := range rows {
+		var row []json.RawMessage
+		if err := json.Unmarshal(raw, &row); err != nil {
+			var metadata struct {
+				Name string `json:"name"`
+			}
+			if i > 0 || json.Unmarshal(raw, &metadata) != nil {
+				return "", nil, fmt.Errorf("error parsing KLE row %d: %w", i, err)
+			}
+			name = metadata.Name
+			continue
+		}
+
+		props := kleProperties{W: 1, H: 1}
+		for _, item := range row {
+			var legend string
+			if err := json.Unmarshal(item, &legend); err == nil {
+				if !props.Decal {
+					keys = append(keys, kleKeyCentre(x, y, props.W, props.H, r, rx, ry))
+				}
+				x += props.W
+				props = kleProperties{W: 1, H: 1}
+				continue
+			}
+
+			next := kleProperties{W: 1, H: 1}
+			if err := json.Unmarshal(item, &next); err != nil {
+				return "", nil, fmt.Errorf("error parsing KLE row %d: %w", i, err)
+			}
+			if next.R != nil {
+				r = *next.R
+			}
+			if next.RX != nil {
+				rx = *next.RX
+				x, y = rx, ry
+			}
+			if next.RY != nil {
+				ry = *next.RY
+				x, y = rx, ry
+			}
+			x += next.X
+			y += next.Y
+			props.W, props.H, props.Decal = next.W, next.H, next.Decal
+		}
+		y++
+		x = rx
+	}
+
+	if len(keys) == 0 {
+		return "", nil, errors.New("no keys found in KLE JSON")
+	}
+	return name, keys, nil
+}
+
+// kleKeyCentre rotates the centre of a key about the rotation origin. KLE
+// rotates clockwise with y increasing down the screen.
+func kleKeyCentre(x, y, w, h, r, rx, ry float64) kleKey {
+	cx, cy := x+w/2, y+h/2
+	angle := r * math.Pi / 180.0
+	sin, cos := math.Sin(angle), math.Cos(angle)
+	return kleKey{
+		x: rx + (cx-rx)*cos - (cy-ry)*sin,
+		y: ry + (cx-rx)*sin + (cy-ry)*cos,
+	}
+}
+
+// relaxedKLE quotes the property names in KLE raw data.
+func relaxedKLE(data []byte) []byte {
+	var out bytes.Buffer
+	inString, escaped, expectName := false, false, false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString, expectName = true, false
+		case c == '{' || c == ',':
+			expectName = true
+		case expectName && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'):
+			j := i
+			for j < len(data) && (data[j] >= 'a' && data[j] <= 'z' || data[j] >= 'A' && data[j] <= 'Z' || data[j] >= '0' && data[j] <= '9' || data[j] == '_') {
+				j++
+			}
+			out.WriteByte('"')
+			out.Write(data[i:j])
+			out.WriteByte('"')
+			i = j - 1
+			expectName = false
+			continue
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			expectName = false
+		}
+		out.WriteByte(c)
+	}
+	return out.Bytes()
+}
+
+// kleMiddle is halfway between the leftmost and rightmost key centres.
+func kleMiddle(keys []kleKey) float64 {
+	minX, maxX := math.Inf(1), math.Inf(-1)
+	for _, key := range keys {
+		minX, maxX = math.Min(minX, key.x), math.Max(maxX, key.x)
+	}
+	return (minX + maxX) / 2
+}
+
+// kleLayout builds a keyboard with every key free to place from KLE keys,
+// splitting them into hands at the split line.
+func kleLayout(name string, keys []kleKey, split float64) (Layout, error) {
+	var left, right []kleKey
+	for _, key := range keys {
+		if key.x < split {
+			left = append(left, key)
+		} else {
+			right = append(right, key)
+		}
+	}
+
+	layout := Layout{Name: name}
+	var err error
+	if layout.Left, err = kleSide(left, true); err != nil {
+		return layout, fmt.Errorf("left side: %w", err)
+	}
+	if layout.Right, err = kleSide(right, false); err != nil {
+		return layout, fmt.Errorf("right side: %w", err)
+	}
+	return layout, nil
+}
+
+// kleSide guesses the rows, fingers and home positions of one hand. Working
+// from left to right, each key joins the row whose last key is nearest in
+// height, so rows follow the stagger of the columns. Short rows at the bottom
+// are taken to be thumb keys. The fingers of the longest row are guessed from
+// the inner edge, two columns for the index finger and the rest for the
+// pinkie, and every other key uses the finger of the nearest key across in
+// that row. The home row is the second row up from the thumbs.
+func kleSide(keys []kleKey, isLeft bool) (Side, error) {
+	var side Side
+	if len(keys) == 0 {
+		return side, errors.New("no keys on this side of the split line")
+	}
+
+	// Group the keys into rows
+	sort.SliceStable(keys, func(i, j int) bool {
+		if keys[i].x != keys[j].x {
+			return keys[i].x < keys[j].x
+		}
+		return keys[i].y < keys[j].y
+	})
+	var rows [][]kleKey
+	for _, key := range keys {
+		best := -1
+		for r, row := range rows {
+			last := row[len(row)-1]
+			if last.x > key.x-0.5 || math.Abs(last.y-key.y) >= 0.5 {
+				continue
+			}
+			if best < 0 || math.Abs(last.y-key.y) < math.Abs(rows[best][len(rows[best])-1].y-key.y) {
+				best = r
+			}
+		}
+		if best < 0 {
+			rows = append(rows, nil)
+			best = len(rows) - 1
+		}
+		rows[best] = append(rows[best], key)
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return kleRowHeight(rows[i]) < kleRowHeight(rows[j]) })
+	longest := 0
+	for _, row := range rows {
+		longest = max(longest, len(row))
+	}
+
+	mainRows := len(rows)
+	for mainRows > 1 && len(rows[mainRows-1])*2 <= longest {
+		mainRows--
+	}
+	homeRow := max(mainRows-2, 0)
+	referenceRow := homeRow
+	for r := 0; r < mainRows; r++ {
+		if len(rows[r]) > len(rows[referenceRow]) {
+			referenceRow = r
+		}
+	}
+
+	// Guess the fingers of the reference row from the inner edge
+	reference := rows[referenceRow]
+	referenceFingers := make([]Finger, len(reference))
+	for c := range reference {
+		fromInside := c
+		if isLeft {
+			fromInside = len(reference) - 1 - c
+		}
+		switch {
+		case fromInside < 2:
+			referenceFingers[c] = Index
+		case fromInside == 2:
+			referenceFingers[c] = Middle
+		case fromInside == 3:
+			referenceFingers[c] = Ring
+		default:
+			referenceFingers[c] = Pinkie
+		}
+	}
+
+	fingers := make([][]Finger, len(rows))
+	for r, row := range rows {
+		fingers[r] = make([]Finger, len(row))
+		for c, key := range row {
+			if r >= mainRows {
+				fingers[r][c] = Thumb
+				continue
+			}
+			nearest := 0
+			for i := range reference {
+				if math.Abs(reference[i].x-key.x) < math.Abs(reference[nearest].x-key.x) {
+					nearest = i
+				}
+			}
+			fingers[r][c] = referenceFingers[nearest]
+		}
+	}
+
+	// Write the rows and the geometry relative to the top left key
+	minX, minY := math.Inf(1), math.Inf(1)
+	for _, key := range keys {
+		minX, minY = math.Min(minX, key.x), math.Min(minY, key.y)
+	}
+	side.Geometry = &Geometry{}
+	side.RawRows = make([][]string, len(rows))
+	side.Geometry.X = make([][]float64, len(rows))
+	side.Geometry.Y = make([][]float64, len(rows))
+	for r, row := range rows {
+		for c, key := range row {
+			side.RawRows[r] = append(side.RawRows[r], "*"+string(fingerChar(fingers[r][c])))
+			side.Geometry.X[r] = append(side.Geometry.X[r], roundKeyUnits(key.x-minX))
+			side.Geometry.Y[r] = append(side.Geometry.Y[r], roundKeyUnits(key.y-minY))
+		}
+	}
+
+	// The index finger rests on the outer of its columns and the pinkie on the
+	// inner of its columns
+	side.IndexHome = kleHome(fingers, homeRow, mainRows, Index, !isLeft)
+	side.MiddleHome = kleHome(fingers, homeRow, mainRows, Middle, isLeft)
+	side.RingHome = kleHome(fingers, homeRow, mainRows, Ring, isLeft)
+	side.PinkieHome = kleHome(fingers, homeRow, mainRows, Pinkie, isLeft)
+
+	// The thumb rests on the thumb key nearest the index finger
+	index := rows[side.IndexHome.Row][side.IndexHome.Col]
+	nearest := math.Inf(1)
+	for r := mainRows; r < len(rows); r++ {
+		for c, key := range rows[r] {
+			if distance := math.Hypot(key.x-index.x, key.y-index.y); distance < nearest {
+				nearest = distance
+				side.ThumbHome = HomePosition{Row: r, Col: c}
+			}
+		}
+	}
+
+	return side, nil
+}
+
+// kleRowHeight is the average height of the keys in a row.
+func kleRowHeight(row []kleKey) float64 {
+	total := 0.0
+	for _, key := range row {
+		total += key.y
+	}
+	return total / float64(len(row))
+}
+
+// kleHome finds the home position of a finger on the home row, or on the
+// nearest row that the finger has a key on. When the finger has several keys
+// the leftmost is chosen, or the rightmost if rightmost is set.
+func kleHome(fingers [][]Finger, homeRow, mainRows int, finger Finger, rightmost bool) HomePosition {
+	for distance := 0; distance < mainRows; distance++ {
+		for _, r := range []int{homeRow + distance, homeRow - distance} {
+			if r < 0 || r >= mainRows {
+				continue
+			}
+			home := -1
+			for c, f := range fingers[r] {
+				if f == finger && (home < 0 || rightmost) {
+					home = c
+				}
+			}
+			if home >= 0 {
+				return HomePosition{Row: r, Col: home}
+			}
+		}
+	}
+	return HomePosition{Row: homeRow}
+}
+
+// roundKeyUnits rounds a position to a thousandth of a key unit.
+func roundKeyUnits(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
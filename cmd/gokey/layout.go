@@ -5,20 +5,42 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"unicode"
 )
 
 type Layout struct {
-	Name              string `json:"name"`
-	SupportsOverrides bool   `json:"supports_overrides"`
-	Left              Side   `json:"left"`
-	Right             Side   `json:"right"`
-	EssentialRunes    []rune
-	FreeToPlaceRunes  int
-	NumberOfKeys      int
+	Name              string            `json:"name"`
+	SupportsOverrides bool              `json:"supports_overrides"`
+	Left              Side              `json:"left"`
+	Right             Side              `json:"right"`
+	Layers            []Layer           `json:"layers,omitempty"`
+	Combos            []Combo           `json:"combos,omitempty"`
+	QMK               *QMK              `json:"qmk,omitempty"`
+	ZMK               *ZMK              `json:"zmk,omitempty"`
+	EssentialRunes    []rune            `json:"-"`
+	FreeToPlaceRunes  int               `json:"-"`
+	NumberOfKeys      int               `json:"-"`
+	ComboKeys         []KeyPhysicalInfo `json:"-"` // Populated after processing Combos
+	Constraints       []Constraint      `json:"-"` // The user's constraints on where runes go
 }
 
+// Layer is an extra layer of keys reached by holding, toggling or tapping a
+// layer key. The base layer is layer 0 and Layers[i] is layer i+1.
+type Layer struct {
+	Name       string `json:"name"`
+	Activation string `json:"activation"`
+}
+
+const (
+	Momentary = "momentary"
+	Toggle    = "toggle"
+	OneShot   = "one-shot"
+)
+
 type Finger int
 
 const (
@@ -29,6 +51,23 @@ const (
 	Pinkie
 )
 
+func (finger Finger) String() string {
+	switch finger {
+	case Thumb:
+		return "Thumb"
+	case Index:
+		return "Index"
+	case Middle:
+		return "Middle"
+	case Ring:
+		return "Ring"
+	case Pinkie:
+		return "Pinkie"
+	default:
+		return "Unknown"
+	}
+}
+
 type Key struct {
 	UnshiftedRune   rune
 	ShiftedRune     rune
@@ -46,16 +85,26 @@ type KeyPhysicalInfo struct {
 	col              int
 	horzDeltaToHome  int
 	vertDeltaToHome  int
+	x                float64 // Position in key units, see Geometry
+	y                float64
+	xToHome          float64 // Offset from the finger's home position in key units
+	yToHome          float64
+	layer            int
+	activation       string             // How a layer key activates its layer
+	combo            []*KeyPhysicalInfo // Keys pressed together for a combo, shared between copies like hand
 }
 
 type Side struct {
-	RawRows    [][]string          `json:"rows"`
-	Rows       [][]KeyPhysicalInfo // Populated after processing RawRows
-	ThumbHome  HomePosition        `json:"thumb_home"`
-	IndexHome  HomePosition        `json:"index_home"`
-	MiddleHome HomePosition        `json:"middle_home"`
-	RingHome   HomePosition        `json:"ring_home"`
-	PinkieHome HomePosition        `json:"pinkie_home"`
+	RawRows    [][]string            `json:"rows"`
+	Rows       [][]KeyPhysicalInfo   `json:"-"` // Populated after processing RawRows
+	RawLayers  map[string][][]string `json:"layers,omitempty"`
+	LayerRows  [][][]KeyPhysicalInfo `json:"-"` // Rows of each layer in Layout.Layers order
+	Geometry   *Geometry             `json:"geometry,omitempty"`
+	ThumbHome  HomePosition          `json:"thumb_home"`
+	IndexHome  HomePosition          `json:"index_home"`
+	MiddleHome HomePosition          `json:"middle_home"`
+	RingHome   HomePosition          `json:"ring_home"`
+	PinkieHome HomePosition          `json:"pinkie_home"`
 }
 
 type HomePosition struct {
@@ -64,7 +113,7 @@ type HomePosition struct {
 }
 
 func ReadLayout(user User) (Layout, error) {
-	filename := p.Sprintf("keyboards/%s.json", user.Keyboard)
+	filename := keyboardFilename(user.Keyboard)
 
 	var layout Layout
 	data, err := os.ReadFile(filename)
@@ -76,6 +125,10 @@ func ReadLayout(user User) (Layout, error) {
 		return layout, err
 	}
 
+	if err := layout.validateLayers(); err != nil {
+		return layout, err
+	}
+
 	// Set up essential runes and be ready to start counting the number of keys
 	layout.EssentialRunes = make([]rune, 0)
 	essentialRunes := make(map[rune]bool)
@@ -92,18 +145,42 @@ func ReadLayout(user User) (Layout, error) {
 	layout.NumberOfKeys += keyCount
 	layout.FreeToPlaceRunes += freeToPlaceRunes
 
-	// Process Essential Runes
-	for r := range essentialRunes {
-		layout.EssentialRunes = append(layout.EssentialRunes, r)
+	// Process the physical positions of the keys
+	if err := layout.Left.ProcessGeometry(true); err != nil {
+		return layout, fmt.Errorf("left side: %w", err)
+	}
+	if err := layout.Right.ProcessGeometry(false); err != nil {
+		return layout, fmt.Errorf("right side: %w", err)
 	}
 
 	// Process the costs
 	layout.ProcessCosts(&layout.Left, user.Left)
 	layout.ProcessCosts(&layout.Right, user.Right)
 
+	// Process the combos, which are priced from the keys they use
+	freeToPlaceRunes, err = layout.ProcessCombos(&essentialRunes, user.Locale)
+	if err != nil {
+		return layout, err
+	}
+	layout.FreeToPlaceRunes += freeToPlaceRunes
+
+	// Process Essential Runes
+	for r := range essentialRunes {
+		layout.EssentialRunes = append(layout.EssentialRunes, r)
+	}
+
 	return layout, nil
 }
 
+// keyboardFilename finds the file for a keyboard name, which may also be a
+// path to a keyboard file.
+func keyboardFilename(name string) string {
+	if strings.HasSuffix(name, ".json") {
+		return name
+	}
+	return fmt.Sprintf("keyboards/%s.json", name)
+}
+
 func (layout *Layout) ProcessRows(s *Side, essentialRunes *map[rune]bool, supportOverrides bool, locale Locale) (int, int, error) {
 	keyCount := 0
 	freeToPlaceRunes := 0
@@ -126,9 +203,86 @@ func (layout *Layout) ProcessRows(s *Side, essentialRunes *map[rune]bool, suppor
 		s.Rows[r] = keyRow
 		keyCount += len(keyRow)
 	}
+
+	// Keys on other layers are on the same physical keys as the base layer
+	// but don't count towards the number of keys
+	s.LayerRows = make([][][]KeyPhysicalInfo, len(layout.Layers))
+	for i, layer := range layout.Layers {
+		rawRows := s.RawLayers[layer.Name]
+		if len(rawRows) > len(s.Rows) {
+			return 0, 0, fmt.Errorf("layer %s has more rows than the base layer", layer.Name)
+		}
+		s.LayerRows[i] = make([][]KeyPhysicalInfo, len(rawRows))
+		for r, row := range rawRows {
+			if len(row) > len(s.Rows[r]) {
+				return 0, 0, fmt.Errorf("layer %s has more keys in row %d than the base layer", layer.Name, r)
+			}
+			keyRow := make([]KeyPhysicalInfo, len(row))
+			for c, keyStr := range row {
+				keyInfo, err := layout.parseKeyString(s, r, c, keyStr, essentialRunes, supportOverrides, locale)
+				if err != nil {
+					return 0, 0, fmt.Errorf("error parsing keyInfo on layer %s at row %d, col %d: %v", layer.Name, r, c, err)
+				}
+				if keyInfo.associatedFinger != s.Rows[r][c].associatedFinger {
+					return 0, 0, fmt.Errorf("key on layer %s at row %d, col %d uses a different finger to the base layer", layer.Name, r, c)
+				}
+				keyInfo.layer = i + 1
+				keyRow[c] = keyInfo
+				if keyInfo.key.UnshiftedIsFree {
+					freeToPlaceRunes++
+				}
+				if keyInfo.key.ShiftedIsFree {
+					freeToPlaceRunes++
+				}
+			}
+			s.LayerRows[i][r] = keyRow
+		}
+	}
+
 	return keyCount, freeToPlaceRunes, nil
 }
 
+// validateLayers checks the layers have unique names and known activations.
+func (layout *Layout) validateLayers() error {
+	names := make(map[string]bool)
+	for i, layer := range layout.Layers {
+		if layer.Name == "" || names[layer.Name] {
+			return fmt.Errorf("layer %d must have a unique name", i+1)
+		}
+		names[layer.Name] = true
+		switch layer.Activation {
+		case "":
+			layout.Layers[i].Activation = Momentary
+		case Momentary, Toggle, OneShot:
+		default:
+			return fmt.Errorf("layer %s has unknown activation %q", layer.Name, layer.Activation)
+		}
+	}
+	for _, side := range []*Side{&layout.Left, &layout.Right} {
+		for name := range side.RawLayers {
+			if !names[name] {
+				return fmt.Errorf("rows given for unknown layer %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// layerIndex returns the number of the layer with the given name.
+func (layout *Layout) layerIndex(name string) (int, bool) {
+	for i, layer := range layout.Layers {
+		if layer.Name == name {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+// layers returns the rows of every layer of the side, base layer first.
+func (s *Side) layers() [][][]KeyPhysicalInfo {
+	return append([][][]KeyPhysicalInfo{s.Rows}, s.LayerRows...)
+}
+
 func (layout *Layout) parseKeyString(s *Side, r, c int, keyStr string, essentialRunes *map[rune]bool, supportOverrides bool, locale Locale) (KeyPhysicalInfo, error) {
 	if len(keyStr) < 2 {
 		return KeyPhysicalInfo{}, fmt.Errorf("invalid key string: %s", keyStr)
@@ -158,13 +312,29 @@ func (layout *Layout) parseKeyString(s *Side, r, c int, keyStr string, essential
 
 	keyContent := keyStr[:len(keyStr)-1]
 
+	// Layer keys are named after their layer, like "@sym"
+	if len(keyContent) > 1 && keyContent[0] == '@' {
+		if layer, ok := layout.layerIndex(keyContent[1:]); ok {
+			key.UnshiftedRune = layerRune(layer)
+			key.ShiftedRune = key.UnshiftedRune
+			keyInfo.activation = layout.Layers[layer-1].Activation
+			(*essentialRunes)[key.UnshiftedRune] = true
+			key.UnshiftedIsFree = false
+			key.ShiftedIsFree = false
+			return keyInfo, nil
+		}
+		if len(keyContent) > 2 || !supportOverrides {
+			return KeyPhysicalInfo{}, fmt.Errorf("unknown layer in key string: %s", keyStr)
+		}
+	}
+
 	switch keyContent {
 	case "*":
 		// Free to place on both layers
 		key.UnshiftedIsFree = true
 		key.ShiftedIsFree = true
 		keyInfo.swappable = true
-	case "\n", "\t", "\b", " ", "^":
+	case "\n", "\t", "\b", " ", "^", "ctrl", "alt":
 		// Control characters
 		key.UnshiftedRune = runeFromString(keyContent)
 		key.ShiftedRune = key.UnshiftedRune
@@ -213,6 +383,14 @@ func (layout *Layout) parseKeyString(s *Side, r, c int, keyStr string, essential
 					(*essentialRunes)[key.ShiftedRune] = true
 					key.ShiftedIsFree = false
 				}
+			} else if first, second, ok := splitEscapedRunes(keyContent); ok && !isEscapedRune(keyContent) {
+				// Both layers given, as written by Save
+				key.UnshiftedRune = runeFromString(first)
+				key.ShiftedRune = runeFromString(second)
+				(*essentialRunes)[key.UnshiftedRune] = true
+				(*essentialRunes)[key.ShiftedRune] = true
+				key.UnshiftedIsFree = false
+				key.ShiftedIsFree = false
 			} else {
 				key.UnshiftedRune = runeFromString(keyContent)
 				(*essentialRunes)[key.UnshiftedRune] = true
@@ -234,13 +412,37 @@ func runeFromString(s string) rune {
 		return '\t'
 	case "\\b":
 		return '\b'
+	case "\\*":
+		return '*'
+	case "\\^":
+		return '^'
 	case "^":
 		return rune(ShiftModifier)
+	case "ctrl":
+		return rune(CtrlModifier)
+	case "alt":
+		return rune(AltModifier)
 	default:
 		return rune(s[0])
 	}
 }
 
+func isEscapedRune(s string) bool {
+	return s == "\\n" || s == "\\t" || s == "\\b" || s == "\\*" || s == "\\^"
+}
+
+// splitEscapedRunes splits the content of a key string written with both of
+// its runes into the two, either of which may be escaped.
+func splitEscapedRunes(s string) (string, string, bool) {
+	for i := 1; i < len(s); i++ {
+		first, second := s[:i], s[i:]
+		if (len(first) == 1 || isEscapedRune(first)) && (len(second) == 1 || isEscapedRune(second)) {
+			return first, second, true
+		}
+	}
+	return "", "", false
+}
+
 func parseFinger(fingerChar byte) (Finger, error) {
 	switch fingerChar {
 	case 'T':
@@ -262,25 +464,47 @@ func (layout *Layout) ProcessCosts(side *Side, hand Hand) {
 	for r := 0; r < len(side.Rows); r++ {
 		for c := 0; c < len(side.Rows[r]); c++ {
 			keyInfo := &side.Rows[r][c]
+			homeX, homeY := side.position(getFingerHomePosition(keyInfo.associatedFinger, *side))
+			keyInfo.xToHome, keyInfo.yToHome = keyInfo.x-homeX, keyInfo.y-homeY
 			keyInfo.cost, keyInfo.vertDeltaToHome, keyInfo.horzDeltaToHome = calculateFingerCost(r, c, hand, *side)
 		}
 	}
+
+	// Keys on other layers cost the same to press as the physical key
+	for _, rows := range side.LayerRows {
+		for r := range rows {
+			for c := range rows[r] {
+				base := side.Rows[r][c]
+				keyInfo := &rows[r][c]
+				keyInfo.cost, keyInfo.vertDeltaToHome, keyInfo.horzDeltaToHome = base.cost, base.vertDeltaToHome, base.horzDeltaToHome
+				keyInfo.x, keyInfo.y, keyInfo.xToHome, keyInfo.yToHome = base.x, base.y, base.xToHome, base.yToHome
+			}
+		}
+	}
 }
 
+// calculateFingerCost returns the cost of a key and its row and column
+// offsets from the finger's home. The horizontal and vertical parts of the
+// move from home are weighted by their costs. On a side with a geometry the
+// cost grows with the straight line distance the finger travels, and
+// otherwise the parts are added as they are on a grid.
 func calculateFingerCost(row, col int, hand Hand, side Side) (float64, int, int) {
 	key := side.Rows[row][col]
 	homePosition := getFingerHomePosition(key.associatedFinger, side)
 	deltaRow := row - homePosition.Row
 	deltaCol := col - homePosition.Col
 	fingerCosts := getFingerCost(key.associatedFinger, hand)
-	baseCost := fingerCosts.Cost
-	baseCost += math.Abs(float64(deltaCol)) * fingerCosts.HCost
-	if deltaRow < 0 {
-		baseCost += math.Abs(float64(deltaRow)) * fingerCosts.UpCost
-	} else if deltaRow > 0 {
-		baseCost += math.Abs(float64(deltaRow)) * fingerCosts.DownCost
+	vCost := 0.0
+	if key.yToHome < 0 {
+		vCost = fingerCosts.UpCost
+	} else if key.yToHome > 0 {
+		vCost = fingerCosts.DownCost
 	}
-	return baseCost, deltaRow, deltaCol
+	horizontal, vertical := key.xToHome*fingerCosts.HCost, key.yToHome*vCost
+	if side.Geometry == nil {
+		return fingerCosts.Cost + math.Abs(horizontal) + math.Abs(vertical), deltaRow, deltaCol
+	}
+	return fingerCosts.Cost + math.Hypot(horizontal, vertical), deltaRow, deltaCol
 }
 
 func getFingerHomePosition(finger Finger, side Side) HomePosition {
@@ -320,45 +544,86 @@ func getFingerCost(finger Finger, hand Hand) FingerCost {
 func (layout *Layout) mapRunesToPhysicalKeyInfo() map[rune]*KeyPhysicalInfo {
 	keyMap := make(map[rune]*KeyPhysicalInfo)
 
-	for r := range layout.Left.Rows {
-		for c, keyInfo := range layout.Left.Rows[r] {
-			if !keyInfo.key.UnshiftedIsFree {
-				keyMap[keyInfo.key.UnshiftedRune] = &layout.Left.Rows[r][c]
-			}
-			if !keyInfo.key.ShiftedIsFree {
-				keyMap[keyInfo.key.ShiftedRune] = &layout.Left.Rows[r][c]
-			}
+	for _, keyInfo := range layout.allKeys() {
+		if !keyInfo.key.UnshiftedIsFree {
+			keyMap[keyInfo.key.UnshiftedRune] = keyInfo
+		}
+		if !keyInfo.key.ShiftedIsFree {
+			keyMap[keyInfo.key.ShiftedRune] = keyInfo
 		}
 	}
 
-	for r := range layout.Right.Rows {
-		for c, keyInfo := range layout.Right.Rows[r] {
-			if !keyInfo.key.UnshiftedIsFree {
-				keyMap[keyInfo.key.UnshiftedRune] = &layout.Right.Rows[r][c]
-			}
-			if !keyInfo.key.ShiftedIsFree {
-				keyMap[keyInfo.key.ShiftedRune] = &layout.Right.Rows[r][c]
-			}
+	return keyMap
+}
+
+// isLeftHand reports whether a key is on the left side of the layout. Keys
+// are compared by their hand pointer as copies of a layout share them.
+func (layout *Layout) isLeftHand(keyInfo *KeyPhysicalInfo) bool {
+	for _, row := range layout.Left.Rows {
+		if len(row) > 0 {
+			return keyInfo.hand == row[0].hand
 		}
 	}
+	return false
+}
 
-	return keyMap
+// samePhysicalKey reports whether two keys, possibly on different layers,
+// are pressed with the same physical key.
+func samePhysicalKey(a, b *KeyPhysicalInfo) bool {
+	return a.hand == b.hand && a.row == b.row && a.col == b.col
 }
 
-func (layout *Layout) GetSwappableKeys() []*Key {
-	var keys []*Key
-	for r := range layout.Left.Rows {
-		for _, keyInfo := range layout.Left.Rows[r] {
-			if keyInfo.swappable {
-				keys = append(keys, keyInfo.key)
+var positionPattern = regexp.MustCompile(`^([LR])(\d+),(\d+)$`)
+
+// isPosition reports whether s names a key position like "L2,3", the key in
+// row 2 and column 3 of the left side.
+func isPosition(s string) bool {
+	return positionPattern.MatchString(s)
+}
+
+// keyAt returns the key on a layer at a position like "L2,3" or "R0,5".
+func (layout *Layout) keyAt(position string, layer int) (*KeyPhysicalInfo, error) {
+	match := positionPattern.FindStringSubmatch(position)
+	if match == nil {
+		return nil, fmt.Errorf("invalid key position %q", position)
+	}
+	side := &layout.Left
+	if match[1] == "R" {
+		side = &layout.Right
+	}
+	rows := side.layers()[layer]
+	row, _ := strconv.Atoi(match[2])
+	col, _ := strconv.Atoi(match[3])
+	if row >= len(rows) || col >= len(rows[row]) {
+		return nil, fmt.Errorf("no key at position %q", position)
+	}
+	return &rows[row][col], nil
+}
+
+// allKeys returns every key on the layout, left side first, with the keys of
+// each side's base layer before those of its other layers. Combos come last.
+func (layout *Layout) allKeys() []*KeyPhysicalInfo {
+	var keyInfos []*KeyPhysicalInfo
+	for _, side := range []*Side{&layout.Left, &layout.Right} {
+		for _, rows := range side.layers() {
+			for r := range rows {
+				for c := range rows[r] {
+					keyInfos = append(keyInfos, &rows[r][c])
+				}
 			}
 		}
 	}
-	for r := range layout.Right.Rows {
-		for _, keyInfo := range layout.Right.Rows[r] {
-			if keyInfo.swappable {
-				keys = append(keys, keyInfo.key)
-			}
+	for i := range layout.ComboKeys {
+		keyInfos = append(keyInfos, &layout.ComboKeys[i])
+	}
+	return keyInfos
+}
+
+func (layout *Layout) GetSwappableKeys() []*Key {
+	var keys []*Key
+	for _, keyInfo := range layout.allKeys() {
+		if keyInfo.swappable {
+			keys = append(keys, keyInfo.key)
 		}
 	}
 	return keys
@@ -377,20 +642,10 @@ func (layout *Layout) AssignRunesToKeys(foundRunes map[rune]int, user User) (map
 
 	// Before we start assigning keys, we'll run over the current layout and mark that certain runes are
 	// already assigned
-	assignedRunes := make(map[rune]int)
-	assignedShiftedRunes := make(map[rune]int)
+	assignedRunes, assignedShiftedRunes := layout.RunesOnKeys(foundRunes)
 	alreadyAssigned := make(map[rune]bool)
-	for _, keyInfo := range orderedKeyInfos {
-		if !keyInfo.key.UnshiftedIsFree {
-			r := keyInfo.key.UnshiftedRune
-			alreadyAssigned[r] = true
-			assignedRunes[r] = foundRunes[r]
-		}
-		if !keyInfo.key.ShiftedIsFree {
-			r := keyInfo.key.ShiftedRune
-			alreadyAssigned[r] = true
-			assignedRunes[r] = foundRunes[r]
-		}
+	for r := range assignedRunes {
+		alreadyAssigned[r] = true
 	}
 
 	i := 0
@@ -443,6 +698,10 @@ func (layout *Layout) AssignRunesToKeys(foundRunes map[rune]int, user User) (map
 					keyInfo.key.UnshiftedIsFree = false
 					alreadyAssigned[runeToAssign] = true
 					assignedRunes[runeToAssign] = foundRunes[runeToAssign]
+				} else if !keyInfo.key.ShiftedIsFree {
+					// Both runes are already on the key
+					k++
+					continue
 				} else {
 					keyInfo.key.ShiftedRune = runeToAssign
 					keyInfo.key.ShiftedIsFree = false
@@ -506,6 +765,26 @@ func (layout *Layout) AssignRunesToKeys(foundRunes map[rune]int, user User) (map
 		}
 	}
 
+	// Letters skip past keys that support overrides and have only their
+	// shifted rune free, so place any symbols left over on those
+	if layout.SupportsOverrides {
+		for _, keyInfo := range orderedKeyInfos {
+			if keyInfo.key.UnshiftedIsFree || !keyInfo.key.ShiftedIsFree {
+				continue
+			}
+			for _, r := range foundRunesToPlace {
+				if !alreadyAssigned[r] && !unicode.IsLetter(r) {
+					keyInfo.key.ShiftedRune = r
+					keyInfo.key.ShiftedIsFree = false
+					alreadyAssigned[r] = true
+					assignedRunes[r] = foundRunes[r]
+					assignedShiftedRunes[r] = foundRunes[r]
+					break
+				}
+			}
+		}
+	}
+
 	if optDebug > 1 {
 		for r, v := range assignedRunes {
 			p.Printf("Assigned rune '%c' to a key (rune was used %d times)\n", RuneDisplayVersion(r), v)
@@ -518,21 +797,39 @@ func (layout *Layout) AssignRunesToKeys(foundRunes map[rune]int, user User) (map
 	return assignedRunes, assignedShiftedRunes
 }
 
-func (layout *Layout) getOrderedKeysByCost() []*KeyPhysicalInfo {
-	var keyInfos []*KeyPhysicalInfo
-
-	for r := range layout.Left.Rows {
-		for c := range layout.Left.Rows[r] {
-			keyInfos = append(keyInfos, &layout.Left.Rows[r][c])
+// RunesOnKeys returns the runes already on the layout's keys and those of them
+// typed with Shift, with how often each is used.
+func (layout *Layout) RunesOnKeys(foundRunes map[rune]int) (map[rune]int, map[rune]int) {
+	runes := make(map[rune]int)
+	shiftedRunes := make(map[rune]int)
+	for _, keyInfo := range layout.allKeys() {
+		if !keyInfo.key.UnshiftedIsFree {
+			r := keyInfo.key.UnshiftedRune
+			runes[r] = foundRunes[r]
 		}
-	}
-	for r := range layout.Right.Rows {
-		for c := range layout.Right.Rows[r] {
-			keyInfos = append(keyInfos, &layout.Right.Rows[r][c])
+		if !keyInfo.key.ShiftedIsFree {
+			r := keyInfo.key.ShiftedRune
+			runes[r] = foundRunes[r]
+			if r != keyInfo.key.UnshiftedRune {
+				shiftedRunes[r] = foundRunes[r]
+			}
 		}
 	}
+	return runes, shiftedRunes
+}
+
+// getOrderedKeysByCost returns the keys cheapest first, filling the base layer
+// before any other layer and leaving combos until last.
+func (layout *Layout) getOrderedKeysByCost() []*KeyPhysicalInfo {
+	keyInfos := layout.allKeys()
 
 	sort.Slice(keyInfos, func(i, j int) bool {
+		if isCombo(keyInfos[i]) != isCombo(keyInfos[j]) {
+			return !isCombo(keyInfos[i])
+		}
+		if keyInfos[i].layer != keyInfos[j].layer {
+			return keyInfos[i].layer < keyInfos[j].layer
+		}
 		return keyInfos[i].cost < keyInfos[j].cost
 	})
 
@@ -555,6 +852,14 @@ func (layout *Layout) deepCopy() Layout {
 	copyLayout.EssentialRunes = make([]rune, len(layout.EssentialRunes))
 	copy(copyLayout.EssentialRunes, layout.EssentialRunes)
 
+	// Deep copy the combos
+	copyLayout.Combos = make([]Combo, len(layout.Combos))
+	copy(copyLayout.Combos, layout.Combos)
+	copyLayout.ComboKeys = make([]KeyPhysicalInfo, len(layout.ComboKeys))
+	for i := range layout.ComboKeys {
+		copyLayout.ComboKeys[i] = layout.ComboKeys[i].DeepCopy()
+	}
+
 	return copyLayout
 }
 
@@ -570,17 +875,28 @@ func (s *Side) DeepCopy() Side {
 	}
 
 	// Deep copy the Rows slice of slices
-	copySide.Rows = make([][]KeyPhysicalInfo, len(s.Rows))
-	for i := range s.Rows {
-		copySide.Rows[i] = make([]KeyPhysicalInfo, len(s.Rows[i]))
-		for j := range s.Rows[i] {
-			copySide.Rows[i][j] = s.Rows[i][j].DeepCopy()
-		}
+	copySide.Rows = deepCopyRows(s.Rows)
+
+	// Deep copy the other layers
+	copySide.LayerRows = make([][][]KeyPhysicalInfo, len(s.LayerRows))
+	for i := range s.LayerRows {
+		copySide.LayerRows[i] = deepCopyRows(s.LayerRows[i])
 	}
 
 	return copySide
 }
 
+func deepCopyRows(rows [][]KeyPhysicalInfo) [][]KeyPhysicalInfo {
+	copyRows := make([][]KeyPhysicalInfo, len(rows))
+	for i := range rows {
+		copyRows[i] = make([]KeyPhysicalInfo, len(rows[i]))
+		for j := range rows[i] {
+			copyRows[i][j] = rows[i][j].DeepCopy()
+		}
+	}
+	return copyRows
+}
+
 func (kpi *KeyPhysicalInfo) DeepCopy() KeyPhysicalInfo {
 	copyKpi := *kpi
 
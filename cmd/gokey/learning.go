@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"unicode"
+)
+
+// ReferenceKey is where a rune is on the user's reference keyboard, the layout
+// they type on today.
+type ReferenceKey struct {
+	Left   bool
+	Row    int
+	Col    int
+	Layer  int
+	Finger Finger
+}
+
+// ReadReference reads the user's reference keyboard and records where each of
+// its runes is. Capital letters move with their lower case letter, so only the
+// lower case letter is kept.
+func ReadReference(user User) (map[rune]ReferenceKey, error) {
+	user.Keyboard = user.RawReference
+	layout, err := ReadLayout(user)
+	if err != nil {
+		return nil, err
+	}
+
+	reference := make(map[rune]ReferenceKey)
+	for r, keyInfo := range layout.mapRunesToPhysicalKeyInfo() {
+		if unicode.IsUpper(r) {
+			continue
+		}
+		reference[r] = ReferenceKey{
+			Left:   layout.isLeftHand(keyInfo),
+			Row:    keyInfo.row,
+			Col:    keyInfo.col,
+			Layer:  keyInfo.layer,
+			Finger: keyInfo.associatedFinger,
+		}
+	}
+	return reference, nil
+}
+
+// learningPenaltyRules returns the layout penalty rules for the runes moved
+// away from the reference keyboard. Runes that move also pay for a change of
+// finger and a change of hand.
+func learningPenaltyRules(user User) []KeyPenalty {
+	if user.Reference == nil {
+		return nil
+	}
+	return []KeyPenalty{
+		{Name: "Moved rune", LayoutFunction: referencePenalty(user.Reference, movedRune), Cost: user.Penalties.MovedRune},
+		{Name: "Moved finger", LayoutFunction: referencePenalty(user.Reference, movedFinger), Cost: user.Penalties.MovedFinger},
+		{Name: "Moved hand", LayoutFunction: referencePenalty(user.Reference, movedHand), Cost: user.Penalties.MovedHand},
+	}
+}
+
+// referencePenalty charges the cost for every rune of the reference keyboard
+// that has moved on the layout.
+func referencePenalty(reference map[rune]ReferenceKey, moved func(ReferenceKey, ReferenceKey) bool) LayoutPenaltyFunc {
+	return func(layout *Layout, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, cost float64) float64 {
+		penalty := 0.0
+		for r, ref := range reference {
+			keyInfo := runesToKeyPhysicalKeyInfoMap[r]
+			if keyInfo == nil {
+				continue
+			}
+			curr := ReferenceKey{
+				Left:   layout.isLeftHand(keyInfo),
+				Row:    keyInfo.row,
+				Col:    keyInfo.col,
+				Layer:  keyInfo.layer,
+				Finger: keyInfo.associatedFinger,
+			}
+			if moved(ref, curr) {
+				penalty += cost
+			}
+		}
+		return penalty
+	}
+}
+
+func movedRune(ref, curr ReferenceKey) bool {
+	return ref.Left != curr.Left || ref.Row != curr.Row || ref.Col != curr.Col || ref.Layer != curr.Layer
+}
+
+func movedFinger(ref, curr ReferenceKey) bool {
+	return ref.Left != curr.Left || ref.Finger != curr.Finger
+}
+
+func movedHand(ref, curr ReferenceKey) bool {
+	return ref.Left != curr.Left
+}
+
+// ApplyReference moves runes to where they are on the reference keyboard, so
+// the optimizer starts from the layout the user already knows.
+func (layout *Layout) ApplyReference(reference map[rune]ReferenceKey) {
+	// Place the runes in a fixed order so seeded runs are reproducible
+	runes := make([]rune, 0, len(reference))
+	for r := range reference {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+
+	for _, r := range runes {
+		ref := reference[r]
+		current := layout.mapRunesToPhysicalKeyInfo()[r]
+		if current == nil || !current.swappable {
+			continue
+		}
+		side := &layout.Right
+		if ref.Left {
+			side = &layout.Left
+		}
+		layers := side.layers()
+		if ref.Layer >= len(layers) || ref.Row < 0 || ref.Row >= len(layers[ref.Layer]) || ref.Col >= len(layers[ref.Layer][ref.Row]) {
+			continue
+		}
+		target := &layers[ref.Layer][ref.Row][ref.Col]
+		if target.swappable && target.key != current.key {
+			swapKeys(current.key, target.key)
+		}
+	}
+}
@@ -12,7 +12,7 @@ type Locale struct {
 }
 
 func LoadUserLocale(locateFile string) (Locale, error) {
-	filename := p.Sprintf("locale/%s.json", locateFile)
+	filename := localeFilename(locateFile)
 
 	// Read the file
 	data, err := os.ReadFile(filename)
@@ -43,3 +43,8 @@ func LoadUserLocale(locateFile string) (Locale, error) {
 
 	return Locale{unshiftedToShifted: unshiftedToShifted, shiftedToUnshifted: shiftedToUnshifted}, nil
 }
+
+// localeFilename returns the path of the locale file with the given name
+func localeFilename(name string) string {
+	return fmt.Sprintf("locale/%s.json", name)
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"fmt"
 	"github.com/spf13/cobra"
 	"golang.org/x/text/message"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"time"
 )
 
+// optimizedSuffix is added to the name of an optimized layout.
+const optimizedSuffix = " (optimized)"
+
 var (
 	r             *rand.Rand
 	p             *message.Printer
@@ -15,6 +22,14 @@ var (
 	optDebug      int
 	optSwaps      int
 	optLayout     string
+	optWorkers    int
+	optSeed       int64
+	optRunsDir    string
+	optCheckpoint int
+	optSave       string
+	optPareto     []string
+	optAlgorithm  string
+	optPopulation int
 	rootCmd       = &cobra.Command{
 		Use:   "gokey [username]",
 		Short: "Generate a personalized keyboard layout.",
@@ -28,7 +43,15 @@ func init() {
 	rootCmd.Flags().IntVarP(&optIterations, "iterations", "i", 10000, "Number of iterations")
 	rootCmd.Flags().IntVarP(&optSwaps, "swaps", "s", 3, "Number key swaps per iteration")
 	rootCmd.Flags().StringVarP(&optLayout, "layout", "l", "", "Override layout name")
-	rootCmd.Flags().IntVarP(&optDebug, "debug", "d", 0, "Debug level (0-2)")
+	rootCmd.Flags().IntVarP(&optWorkers, "workers", "w", 1, "Number of annealing chains to run in parallel (0 for one per CPU)")
+	rootCmd.Flags().Int64Var(&optSeed, "seed", 0, "Random seed for a reproducible run (defaults to the current time)")
+	rootCmd.Flags().StringVar(&optRunsDir, "runs-dir", "runs", "Directory to write run manifests to")
+	rootCmd.Flags().IntVar(&optCheckpoint, "checkpoint-every", 10000, "Iterations between checkpoints (0 to only checkpoint on interrupt)")
+	rootCmd.Flags().StringVar(&optSave, "save", "", "Also save the best layout as keyboards/<name>.json")
+	rootCmd.Flags().StringSliceVar(&optPareto, "pareto", nil, "Penalty rules to keep a Pareto front of, like \"SFB,Roll reversal\"")
+	rootCmd.Flags().StringVar(&optAlgorithm, "algorithm", AnnealingAlgorithm, "Optimizer to use: sa for simulated annealing or ga for a genetic algorithm")
+	rootCmd.Flags().IntVar(&optPopulation, "population", 50, "Number of layouts in each generation of the genetic algorithm")
+	rootCmd.PersistentFlags().IntVarP(&optDebug, "debug", "d", 0, "Debug level (0-2)")
 }
 
 func main() {
@@ -48,6 +71,14 @@ func main() {
 func run(cmd *cobra.Command, args []string) {
 	username := args[0]
 
+	// Seed the random number generator before anything is randomized so the
+	// whole run can be repeated
+	seed := optSeed
+	if !cmd.Flags().Changed("seed") {
+		seed = time.Now().UnixNano()
+	}
+	r = rand.New(rand.NewSource(seed))
+
 	// In the future I will take the user json and corpus from the command line
 	userConfigFile := "users/" + username + ".json"
 	user, err := ReadUser(userConfigFile)
@@ -55,6 +86,46 @@ func run(cmd *cobra.Command, args []string) {
 		panic(err)
 	}
 
+	if optAlgorithm != AnnealingAlgorithm && optAlgorithm != GeneticAlgorithm {
+		p.Printf("Unknown algorithm %q, expected %s or %s\n", optAlgorithm, AnnealingAlgorithm, GeneticAlgorithm)
+		return
+	}
+	if optAlgorithm == GeneticAlgorithm && len(optPareto) > 0 {
+		p.Println("The genetic algorithm can't keep a Pareto front, use --algorithm sa")
+		return
+	}
+	if err := checkSaveName(optSave); err != nil {
+		p.Println(err)
+		return
+	}
+
+	// Keep the front of layouts trading off the chosen rules if asked to
+	var archive *ParetoArchive
+	if len(optPareto) > 0 {
+		archive, err = NewParetoArchive(optPareto, user)
+		if err != nil {
+			p.Println(err)
+			return
+		}
+	}
+
+	// Record how this run was started
+	manifest, err := NewRunManifest(cmd, username, userConfigFile, user, seed)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	runDir, err := makeRunDir(optRunsDir, username, manifest.Started)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	if err := manifest.Write(runDir); err != nil {
+		p.Println(err)
+		return
+	}
+	p.Printf("Run %s (seed %s)\n", runDir, fmt.Sprint(seed))
+
 	quartadInfo, err := GetQuartadList(user.Corpus, user)
 	if err != nil {
 		p.Println(err)
@@ -67,5 +138,79 @@ func run(cmd *cobra.Command, args []string) {
 
 	p.Println(user.Layout.StringWithCosts())
 
-	Optimize(quartadInfo, user.Layout, user, optIterations, optSwaps)
+	workers := optWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if archive != nil && workers == 1 {
+		// Only chains after the first weight the chosen rules differently
+		p.Println("A single chain only searches the Pareto front with your penalties, use --workers to explore more of it")
+	}
+
+	// Save checkpoints into the run directory so the run can be resumed
+	checkpointer := &Checkpointer{
+		Path:  filepath.Join(runDir, "checkpoint.json"),
+		Every: optCheckpoint,
+		Checkpoint: Checkpoint{
+			Username:   username,
+			UserFile:   userConfigFile,
+			Keyboard:   user.Keyboard,
+			Seed:       seed,
+			Iterations: optIterations,
+			Swaps:      optSwaps,
+		},
+	}
+	if archive != nil || optAlgorithm == GeneticAlgorithm {
+		// The front and the population aren't saved in checkpoints so the run
+		// can't be resumed
+		checkpointer = nil
+	}
+	watchForInterrupt()
+
+	bestLayout := Optimize(quartadInfo, user.Layout, user, nil, archive, optIterations, optSwaps, workers, checkpointer)
+	saveBestLayout(bestLayout, runDir, optSave)
+	if archive != nil {
+		archive.Print()
+		if err := archive.Save(runDir, user.Layout); err != nil {
+			p.Println(err)
+		}
+	}
+}
+
+// saveBestLayout writes the best layout to the run directory and, if a name is
+// given, to the keyboards directory so it can be loaded with --layout.
+func saveBestLayout(bestLayout BestLayoutEntry, runDir string, name string) {
+	layout := bestLayout.Layout.Duplicate()
+	if !strings.HasSuffix(layout.Name, optimizedSuffix) {
+		layout.Name += optimizedSuffix
+	}
+
+	filenames := []string{filepath.Join(runDir, "layout.json")}
+	if len(name) > 0 {
+		if err := checkSaveName(name); err != nil {
+			p.Println(err)
+		} else {
+			filenames = append(filenames, keyboardFilename(name))
+		}
+	}
+	for _, filename := range filenames {
+		if err := layout.Save(filename); err != nil {
+			p.Println(err)
+			continue
+		}
+		p.Printf("Saved best layout to %s\n", filename)
+	}
+}
+
+// checkSaveName makes sure saving a layout with --save won't overwrite an
+// existing keyboard file.
+func checkSaveName(name string) error {
+	if len(name) == 0 {
+		return nil
+	}
+	filename := keyboardFilename(name)
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("%s already exists, choose another name to --save as", filename)
+	}
+	return nil
 }
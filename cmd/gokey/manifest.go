@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+const manifestVersion = 1
+
+// RunManifest records everything needed to repeat an optimization run: the
+// seed, the command line flags and hashes of every input file.
+type RunManifest struct {
+	Version   int               `json:"version"`
+	Started   time.Time         `json:"started"`
+	Username  string            `json:"username"`
+	Seed      int64             `json:"seed"`
+	Flags     map[string]string `json:"flags"`
+	UserFile  FileHash          `json:"user_file"`
+	Keyboard  FileHash          `json:"keyboard"`
+	Locale    FileHash          `json:"locale"`
+	Corpus    []FileHash        `json:"corpus"`
+	Shortcuts []FileHash        `json:"shortcuts,omitempty"`
+	Members   []RunManifest     `json:"members,omitempty"` // The other users of a team run
+}
+
+type FileHash struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewRunManifest hashes the user's input files and captures the flags the run
+// was started with.
+func NewRunManifest(cmd *cobra.Command, username string, userConfigFile string, user User, seed int64) (RunManifest, error) {
+	manifest := RunManifest{
+		Version:  manifestVersion,
+		Started:  time.Now(),
+		Username: username,
+		Seed:     seed,
+		Flags:    make(map[string]string),
+	}
+
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		manifest.Flags[f.Name] = f.Value.String()
+	})
+	manifest.Flags["seed"] = fmt.Sprint(seed)
+
+	var err error
+	if manifest.UserFile, err = hashFile(userConfigFile); err != nil {
+		return RunManifest{}, err
+	}
+	if manifest.Keyboard, err = hashFile(keyboardFilename(user.Keyboard)); err != nil {
+		return RunManifest{}, err
+	}
+	if manifest.Locale, err = hashFile(localeFilename(user.RawLocale)); err != nil {
+		return RunManifest{}, err
+	}
+	corpusFiles, err := corpusFiles(user.Corpus)
+	if err != nil {
+		return RunManifest{}, err
+	}
+	for _, corpusFile := range corpusFiles {
+		hash, err := hashFile(corpusFile)
+		if err != nil {
+			return RunManifest{}, err
+		}
+		manifest.Corpus = append(manifest.Corpus, hash)
+	}
+	for _, shortcutFile := range user.RawShortcuts {
+		hash, err := hashFile(shortcutFile)
+		if err != nil {
+			return RunManifest{}, err
+		}
+		manifest.Shortcuts = append(manifest.Shortcuts, hash)
+	}
+
+	return manifest, nil
+}
+
+// Write saves the manifest as manifest.json in the run directory.
+func (manifest RunManifest) Write(runDir string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(runDir, "manifest.json"), data, 0o644)
+}
+
+// makeRunDir creates the directory that holds the outputs of a single run.
+// Runs started in the same second get a numbered suffix so they never share a
+// directory.
+func makeRunDir(runsDir string, username string, started time.Time) (string, error) {
+	if err := os.MkdirAll(runsDir, 0o755); err != nil {
+		return "", fmt.Errorf("error creating run directory: %w", err)
+	}
+	name := fmt.Sprintf("%s-%s", username, started.Format("20060102-150405"))
+	runDir := filepath.Join(runsDir, name)
+	for n := 2; ; n++ {
+		err := os.Mkdir(runDir, 0o755)
+		if err == nil {
+			return runDir, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("error creating run directory: %w", err)
+		}
+		runDir = filepath.Join(runsDir, fmt.Sprintf("%s-%d", name, n))
+	}
+}
+
+func hashFile(filename string) (FileHash, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return FileHash{}, fmt.Errorf("error hashing file: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return FileHash{}, fmt.Errorf("error hashing file: %w", err)
+	}
+	return FileHash{Path: filename, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import "math"
+
+// LayoutMetrics are the statistics commonly published by other layout
+// analyzers. They are counts of bigrams and trigrams from the corpus and don't
+// depend on the user's penalty weights. Like other analyzers, which ignore the
+// space bar, only bigrams and trigrams typed entirely by fingers on the layout
+// are counted. Modifiers are ignored.
+type LayoutMetrics struct {
+	Bigrams      int
+	SFB          int // Same finger bigrams, not counting repeats of a key
+	Scissors     int // Adjacent fingers two or more rows apart relative to their homes
+	Trigrams     int
+	SkipBigrams  int // Same finger on the first and last keys of a trigram
+	InwardRolls  int // Two keys on one hand rolling towards the index
+	OutwardRolls int
+	Alternation  int // Hands alternate on every key
+	OneHandIn    int // Three keys on one hand rolling towards the index
+	OneHandOut   int
+	Redirects    int // Three keys on one hand changing direction
+	Load         FingerLoad
+}
+
+type metric struct {
+	Name  string
+	Count int
+	Of    int
+}
+
+// CalculateMetrics classifies the bigram and trigram quartads on the layout.
+func CalculateMetrics(layout Layout, quartads QuartadList, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo) LayoutMetrics {
+	metrics := LayoutMetrics{Load: CalculateFingerLoad(layout, quartads, runesToKeyPhysicalKeyInfoMap)}
+
+	for quartad, count := range quartads {
+		switch quartad.Len() {
+		case 2:
+			curr := getKey(quartad, 0, runesToKeyPhysicalKeyInfoMap)
+			old1 := getKey(quartad, 1, runesToKeyPhysicalKeyInfoMap)
+			if !isFingerKey(curr) || !isFingerKey(old1) {
+				continue
+			}
+			metrics.Bigrams += count
+			if isSFB(old1, curr) {
+				metrics.SFB += count
+			}
+			if isScissor(old1, curr) {
+				metrics.Scissors += count
+			}
+		case 3:
+			curr := getKey(quartad, 0, runesToKeyPhysicalKeyInfoMap)
+			old1 := getKey(quartad, 1, runesToKeyPhysicalKeyInfoMap)
+			old2 := getKey(quartad, 2, runesToKeyPhysicalKeyInfoMap)
+			if !isFingerKey(curr) || !isFingerKey(old1) || !isFingerKey(old2) {
+				continue
+			}
+			metrics.Trigrams += count
+			if isSFB(old2, curr) {
+				metrics.SkipBigrams += count
+			}
+			metrics.classifyTrigram(old2, old1, curr, count)
+		}
+	}
+
+	return metrics
+}
+
+// classifyTrigram counts a trigram as a roll, alternation, one hand roll or
+// redirect. Trigrams containing a same finger bigram are none of these.
+func (metrics *LayoutMetrics) classifyTrigram(first, second, third *KeyPhysicalInfo, count int) {
+	switch {
+	case first.hand != second.hand && second.hand != third.hand:
+		metrics.Alternation += count
+	case first.hand == second.hand && second.hand == third.hand:
+		if first.associatedFinger == second.associatedFinger || second.associatedFinger == third.associatedFinger {
+			return
+		}
+		inward1 := second.associatedFinger < first.associatedFinger
+		inward2 := third.associatedFinger < second.associatedFinger
+		switch {
+		case inward1 != inward2:
+			metrics.Redirects += count
+		case inward1:
+			metrics.OneHandIn += count
+		default:
+			metrics.OneHandOut += count
+		}
+	default:
+		// Two consecutive keys on one hand and one on the other
+		from, to := first, second
+		if second.hand == third.hand {
+			from, to = second, third
+		}
+		switch {
+		case to.associatedFinger < from.associatedFinger:
+			metrics.InwardRolls += count
+		case to.associatedFinger > from.associatedFinger:
+			metrics.OutwardRolls += count
+		}
+	}
+}
+
+func isFingerKey(keyInfo *KeyPhysicalInfo) bool {
+	return keyInfo != nil && keyInfo.associatedFinger != Thumb && !isCombo(keyInfo)
+}
+
+func isSFB(from, to *KeyPhysicalInfo) bool {
+	return from.hand == to.hand && from.associatedFinger == to.associatedFinger && !samePhysicalKey(from, to)
+}
+
+func isScissor(from, to *KeyPhysicalInfo) bool {
+	if from.hand != to.hand {
+		return false
+	}
+	return AbsI(int(from.associatedFinger)-int(to.associatedFinger)) == 1 &&
+		math.Abs(from.yToHome-to.yToHome) >= 2-geometryTolerance
+}
+
+// List returns each metric with the number of bigrams or trigrams it is a
+// share of.
+func (metrics LayoutMetrics) List() []metric {
+	return []metric{
+		{"SFB", metrics.SFB, metrics.Bigrams},
+		{"Scissors", metrics.Scissors, metrics.Bigrams},
+		{"DSFB (skip bigrams)", metrics.SkipBigrams, metrics.Trigrams},
+		{"Inward rolls", metrics.InwardRolls, metrics.Trigrams},
+		{"Outward rolls", metrics.OutwardRolls, metrics.Trigrams},
+		{"Alternation", metrics.Alternation, metrics.Trigrams},
+		{"One hand inward", metrics.OneHandIn, metrics.Trigrams},
+		{"One hand outward", metrics.OneHandOut, metrics.Trigrams},
+		{"Redirects", metrics.Redirects, metrics.Trigrams},
+	}
+}
+
+func (m metric) Percent() float64 {
+	if m.Of == 0 {
+		return 0
+	}
+	return float64(m.Count) / float64(m.Of) * 100.0
+}
+
+func printMetrics(metrics LayoutMetrics) {
+	for _, m := range metrics.List() {
+		p.Printf("%33s: %6.2f%%\n", m.Name, m.Percent())
+	}
+	p.Println()
+	printFingerLoad(metrics.Load)
+}
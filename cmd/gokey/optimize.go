@@ -2,6 +2,8 @@ package main
 
 import (
 	"math"
+	"math/rand"
+	"strings"
 	"time"
 
 	"atomicgo.dev/cursor"
@@ -12,74 +14,201 @@ type BestLayoutEntry struct {
 	Penalty float64
 }
 
-func Optimize(quartadInfo QuartadInfo, layout Layout, user User, iterations int, numSwaps int) {
+// Optimize searches for the best layout using simulated annealing, or the
+// genetic algorithm if it was chosen with --algorithm. With more than one
+// worker, independent chains are run in parallel and the best result across
+// all of them is reported. If team is not nil the layout is scored for
+// every member of the team rather than just the user. If archive is not nil
+// the layouts on the Pareto front of its objectives are kept in it. If
+// checkpointer is not nil the chains save their state periodically and when
+// interrupted.
+func Optimize(quartadInfo QuartadInfo, layout Layout, user User, team *Team, archive *ParetoArchive, iterations int, numSwaps int, workers int, checkpointer *Checkpointer) BestLayoutEntry {
+	if workers > 1 {
+		return OptimizeParallel(quartadInfo, layout, user, team, archive, iterations, numSwaps, workers, checkpointer)
+	}
+
+	// Capture the start time for ETA calculation
+	startTime := time.Now()
+
+	chain := AnnealingChain{
+		QuartadInfo:  quartadInfo,
+		User:         user,
+		Team:         team,
+		Archive:      archive,
+		Iterations:   iterations,
+		NumSwaps:     numSwaps,
+		Rng:          r,
+		ShowProgress: true,
+		Checkpointer: checkpointer,
+	}
+	bestLayout := newOptimizer(&chain).Run(layout, nil)
+
+	// Print the best layouts found
+	printBestLayout(startTime, quartadInfo, user, team, bestLayout, iterations+1)
+	reportInterrupted(checkpointer)
+
+	return bestLayout
+}
+
+// AnnealingChain holds the settings for one simulated annealing chain. Each
+// chain needs its own random number generator. When ShowProgress is set the
+// chain redraws the progress display as it goes, so only one chain at a time
+// may show progress. Chains running in the background report through Status
+// instead.
+type AnnealingChain struct {
+	QuartadInfo  QuartadInfo
+	User         User
+	Team         *Team
+	Archive      *ParetoArchive
+	Iterations   int
+	NumSwaps     int
+	Rng          *rand.Rand
+	ShowProgress bool
+	Status       *chainStatus
+	Checkpointer *Checkpointer
+}
+
+// ChainState is the position of an annealing chain part way through its
+// schedule.
+type ChainState struct {
+	NextIteration int
+	Accepted      Layout
+	Best          BestLayoutEntry
+}
+
+// Run anneals from the given layout. Passing a state continues a chain from
+// that point in the schedule instead of from the start.
+func (chain *AnnealingChain) Run(layout Layout, resume *ChainState) BestLayoutEntry {
 	// Capture the start time for ETA calculation
 	startTime := time.Now()
 
+	user := chain.User
+	quartadInfo := chain.QuartadInfo
+	rng := chain.Rng
+
 	initLayout := layout.Duplicate()
-	penaltyRules := InitPenaltyRules(user)
-	outputRows := len(layout.Left.Rows) + 8
-	if optDebug > 1 {
-		outputRows += len(penaltyRules) + 1
+	if resume != nil {
+		initLayout = resume.Accepted.Duplicate()
 	}
+	penaltyRules := InitPenaltyRules(user)
 
-	if optDebug > 0 {
+	if chain.ShowProgress && optDebug > 0 {
 		p.Println("Initial layout:")
 		p.Print(initLayout.String())
 	}
 
-	runesToKeyPhysicalKeyInfoMap := initLayout.mapRunesToPhysicalKeyInfo()
-	initialPenalty, initialResults := CalculatePenalty(quartadInfo.Quartads, initLayout, runesToKeyPhysicalKeyInfoMap, &penaltyRules)
+	// The evaluator owns the accepted layout and rescores only the quartads
+	// touched by each shuffle. Its total is used rather than the initial
+	// penalty so every comparison is made on the same summation order.
+	acceptedLayout := initLayout.Duplicate()
+	var evaluator Evaluator
+	var pareto *ParetoEvaluator
+	if chain.Team != nil {
+		evaluator = chain.Team.NewEvaluator(&acceptedLayout)
+	} else if chain.Archive != nil {
+		pareto = NewParetoEvaluator(quartadInfo.Quartads, &acceptedLayout, penaltyRules, chain.Archive)
+		evaluator = pareto
+	} else {
+		evaluator = NewPenaltyEvaluator(quartadInfo.Quartads, &acceptedLayout, &penaltyRules)
+	}
+
+	_, initialResults := evaluator.Results()
 	watermarkPenalty := user.StartingPenaltyWatermark
-	PrintProgress(startTime, 0, 1, initLayout, 1.0, 1.0, initialResults, nil)
+	outputRows := strings.Count(layout.String(), "\n") + 6
+	if optDebug > 1 {
+		outputRows += len(initialResults) + 1
+	}
+	if chain.ShowProgress {
+		PrintProgress(startTime, 0, 1, initLayout, 1.0, 1.0, initialResults, nil)
+	}
 
 	// Initialize simulated annealing
-	sa := NewSimulatedAnnealing(iterations)
+	sa := NewSimulatedAnnealing(chain.Iterations, rng)
+	acceptedPenalty := evaluator.Score()
+	acceptedPenaltyResults := initialResults
 
 	// Initialize best layouts list
 	var bestLayout BestLayoutEntry
-	bestLayout = BestLayoutEntry{Layout: initLayout.Duplicate(), Penalty: initialPenalty}
-
-	acceptedLayout := initLayout.Duplicate()
-	acceptedPenalty := initialPenalty
-	acceptedPenaltyResults := initialResults
+	bestLayout = BestLayoutEntry{Layout: initLayout.Duplicate(), Penalty: acceptedPenalty}
 
 	start, end := sa.GetSimulationRange()
+	if resume != nil {
+		start = resume.NextIteration
+		bestLayout = BestLayoutEntry{Layout: resume.Best.Layout.Duplicate(), Penalty: resume.Best.Penalty}
+	}
 	for i := start; i < end; i++ {
 		if i%100 == 0 {
-			cursor.StartOfLineUp(outputRows)
-			PrintProgress(startTime, i, end, acceptedLayout, acceptedPenalty, watermarkPenalty, acceptedPenaltyResults, &bestLayout)
+			if chain.ShowProgress {
+				cursor.StartOfLineUp(outputRows)
+				PrintProgress(startTime, i, end, acceptedLayout, acceptedPenalty, watermarkPenalty, acceptedPenaltyResults, &bestLayout)
+			}
+			chain.Status.update(i, bestLayout.Penalty)
 		}
 
-		// Create a new layout by shuffling the accepted layout
-		currLayout := acceptedLayout.Duplicate()
-		currLayout.Shuffle(r.Intn(numSwaps) + 1)
-		runesToKeyPhysicalKeyInfoMap := currLayout.mapRunesToPhysicalKeyInfo()
+		// Save the chain periodically, and stop if we have been interrupted
+		stop := interrupted.Load()
+		if chain.Checkpointer.Due(i, start) || stop {
+			state := ChainState{NextIteration: i, Accepted: acceptedLayout, Best: bestLayout}
+			if err := chain.Checkpointer.Save(state, sa, rng); err != nil {
+				p.Println(err)
+			}
+		}
+		if stop {
+			return bestLayout
+		}
 
-		// Calculate the penalty for the new layout
-		currPenalty, currPenaltyResults := CalculatePenalty(quartadInfo.Quartads, currLayout, runesToKeyPhysicalKeyInfoMap, &penaltyRules)
+		// Create a new layout by shuffling the accepted layout and rescore it
+		evaluator.Shuffle(rng, rng.Intn(chain.NumSwaps)+1)
+		currPenalty := evaluator.Score()
+		if pareto != nil {
+			chain.Archive.Offer(pareto.Objectives(), evaluator.Layout())
+		}
 
 		// Check if this is the best layout so far
 		if currPenalty < bestLayout.Penalty {
-			bestLayout = BestLayoutEntry{Layout: currLayout.Duplicate(), Penalty: currPenalty}
+			bestLayout = BestLayoutEntry{Layout: evaluator.Layout().Duplicate(), Penalty: currPenalty}
 		}
 
 		// Decide whether to accept the new layout
 		if sa.AcceptTransition(currPenalty-acceptedPenalty, i) {
-			acceptedLayout = currLayout.Duplicate()
+			evaluator.Commit()
 			acceptedPenalty = currPenalty
-			acceptedPenaltyResults = currPenaltyResults
+			if chain.ShowProgress && optDebug > 0 {
+				// The per-rule breakdown is only displayed when debugging
+				_, acceptedPenaltyResults = evaluator.Results()
+			}
 
-			cursor.StartOfLineUp(outputRows)
-			PrintProgress(startTime, i, end, acceptedLayout, acceptedPenalty, watermarkPenalty, acceptedPenaltyResults, &bestLayout)
+			if chain.ShowProgress {
+				cursor.StartOfLineUp(outputRows)
+				PrintProgress(startTime, i, end, acceptedLayout, acceptedPenalty, watermarkPenalty, acceptedPenaltyResults, &bestLayout)
+			}
+		} else {
+			evaluator.Revert()
 		}
 	}
+	chain.Status.update(end-1, bestLayout.Penalty)
 
-	// Print the best layouts found
+	return bestLayout
+}
+
+// printBestLayout rescores the best layout in full and prints it with its
+// penalty breakdown, followed by each member's score for a team.
+func printBestLayout(startTime time.Time, quartadInfo QuartadInfo, user User, team *Team, bestLayout BestLayoutEntry, end int) {
 	p.Println("\nBest layout:")
-	runesToKeyPhysicalKeyInfoMap = bestLayout.Layout.mapRunesToPhysicalKeyInfo()
-	finalPenalty, finalResults := CalculatePenalty(quartadInfo.Quartads, bestLayout.Layout, runesToKeyPhysicalKeyInfoMap, &penaltyRules)
-	PrintProgress(startTime, end, end, bestLayout.Layout, finalPenalty, watermarkPenalty, finalResults, &bestLayout)
+	var finalPenalty float64
+	var finalResults []KeyPenaltyResult
+	if team != nil {
+		layout := bestLayout.Layout.Duplicate()
+		finalPenalty, finalResults = team.NewEvaluator(&layout).Results()
+	} else {
+		penaltyRules := InitPenaltyRules(user)
+		runesToKeyPhysicalKeyInfoMap := bestLayout.Layout.mapRunesToPhysicalKeyInfo()
+		finalPenalty, finalResults = CalculatePenalty(quartadInfo.Quartads, bestLayout.Layout, runesToKeyPhysicalKeyInfoMap, &penaltyRules)
+	}
+	PrintProgress(startTime, end, end, bestLayout.Layout, finalPenalty, user.StartingPenaltyWatermark, finalResults, &bestLayout)
+	if team != nil {
+		team.printScores(bestLayout.Layout)
+	}
 }
 
 func PrintProgress(startTime time.Time, i int, end int, acceptedLayout Layout, acceptedPenalty float64, watermarkPenalty float64, acceptedPenaltyResults []KeyPenaltyResult, bestLayout *BestLayoutEntry) {
@@ -127,28 +256,41 @@ func printPenaltyResults(current, watermark float64, results []KeyPenaltyResult,
 	}
 }
 
-func (layout *Layout) Shuffle(numSwaps int) {
+func (layout *Layout) Shuffle(rng *rand.Rand, numSwaps int) {
 	swappableKeys := layout.GetSwappableKeys()
 
 	for i := 0; i < numSwaps; i++ {
-		layout.shufflePosition(swappableKeys)
+		layout.shufflePosition(rng, swappableKeys)
 	}
 }
 
-func (layout *Layout) shufflePosition(swappableKeys []*Key) {
+func (layout *Layout) shufflePosition(rng *rand.Rand, swappableKeys []*Key) {
 	if len(swappableKeys) < 2 {
 		return // Not enough swappable keys to perform a swap
 	}
 
-	// Select two distinct random indices
-	i := r.Intn(len(swappableKeys))
-	j := r.Intn(len(swappableKeys) - 1)
+	// Swap the content of the keys, undoing swaps that break a hard constraint
+	a, b := randomKeyPair(rng, swappableKeys)
+	swapKeys(a, b)
+	if layout.hasHardConstraints() && !layout.meetsHardConstraints(layout.mapRunesToPhysicalKeyInfo()) {
+		swapKeys(a, b)
+	}
+}
+
+// randomKeyPair selects two distinct keys at random
+func randomKeyPair(rng *rand.Rand, swappableKeys []*Key) (*Key, *Key) {
+	i, j := randomPair(rng, len(swappableKeys))
+	return swappableKeys[i], swappableKeys[j]
+}
+
+// randomPair selects two distinct indexes below n at random
+func randomPair(rng *rand.Rand, n int) (int, int) {
+	i := rng.Intn(n)
+	j := rng.Intn(n - 1)
 	if j >= i {
 		j++
 	}
-
-	// Swap the content of the keys
-	swapKeys(swappableKeys[i], swappableKeys[j])
+	return i, j
 }
 
 func swapKeys(a, b *Key) {
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"atomicgo.dev/cursor"
+)
+
+// chainStatus is how an annealing chain running in the background reports its
+// progress to the display goroutine.
+type chainStatus struct {
+	mu        sync.Mutex
+	iteration int
+	best      float64
+	done      bool
+}
+
+func (s *chainStatus) update(iteration int, best float64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.iteration = iteration
+	s.best = best
+	s.mu.Unlock()
+}
+
+func (s *chainStatus) finish() {
+	s.mu.Lock()
+	s.done = true
+	s.mu.Unlock()
+}
+
+func (s *chainStatus) snapshot() (int, float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.iteration, s.best, s.done
+}
+
+// OptimizeParallel runs independent annealing chains, one per worker, and
+// reports the best layout found along with the spread of results. Each chain
+// starts from its own shuffle of the layout and has its own random number
+// generator so the chains explore different parts of the search space.
+func OptimizeParallel(quartadInfo QuartadInfo, layout Layout, user User, team *Team, archive *ParetoArchive, iterations int, numSwaps int, workers int, checkpointer *Checkpointer) BestLayoutEntry {
+	startTime := time.Now()
+
+	// Seed every chain from the main generator up front so the chains don't
+	// share it while running
+	rngs := make([]*rand.Rand, workers)
+	for w := range rngs {
+		rngs[w] = rand.New(rand.NewSource(r.Int63()))
+	}
+
+	chains := make([]parallelChain, workers)
+	archives := make([]*ParetoArchive, workers)
+	for w := range chains {
+		chainLayout := layout.Duplicate()
+		chainLayout.Shuffle(rngs[w], len(chainLayout.GetSwappableKeys()))
+		archives[w] = archive.ForChain(w+1, rngs[w])
+
+		chains[w] = parallelChain{Number: w + 1, Layout: chainLayout, Status: &chainStatus{}}
+		chains[w].Optimizer = newOptimizer(&AnnealingChain{
+			QuartadInfo:  quartadInfo,
+			User:         user,
+			Team:         team,
+			Archive:      archives[w],
+			Iterations:   iterations,
+			NumSwaps:     numSwaps,
+			Rng:          rngs[w],
+			Status:       chains[w].Status,
+			Checkpointer: checkpointer.ForChain(w + 1),
+		})
+	}
+
+	p.Printf("Running %d chains of %d iterations\n", workers, iterations)
+	results := runChains(startTime, chains, iterations)
+
+	// Gather the Pareto fronts of the chains into one
+	if archive != nil {
+		for _, chainArchive := range archives {
+			archive.Merge(chainArchive)
+		}
+	}
+
+	best := reportChains(chains, results)
+	printBestLayout(startTime, quartadInfo, user, team, results[best], iterations+1)
+	reportInterrupted(checkpointer)
+
+	return results[best]
+}
+
+// parallelChain is one of the chains run together by runChains. A chain with
+// a state to resume continues from it rather than starting from its layout.
+type parallelChain struct {
+	Number    int
+	Optimizer Optimizer
+	Layout    Layout
+	Resume    *ChainState
+	Status    *chainStatus
+}
+
+// runChains runs the chains in parallel, redrawing a status line per chain
+// until they have all finished, and returns the best layout each one found.
+func runChains(startTime time.Time, chains []parallelChain, iterations int) []BestLayoutEntry {
+	results := make([]BestLayoutEntry, len(chains))
+	var wg sync.WaitGroup
+	for w, chain := range chains {
+		wg.Add(1)
+		go func(w int, chain parallelChain) {
+			defer wg.Done()
+			results[w] = chain.Optimizer.Run(chain.Layout, chain.Resume)
+			chain.Status.finish()
+		}(w, chain)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	printChainStatuses(startTime, chains, iterations, false)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		case <-ticker.C:
+		}
+		printChainStatuses(startTime, chains, iterations, true)
+	}
+
+	return results
+}
+
+// reportChains prints the results of the chains ranked by penalty along with
+// their spread, and returns the index of the winner.
+func reportChains(chains []parallelChain, results []BestLayoutEntry) int {
+	order := make([]int, len(results))
+	for w := range order {
+		order[w] = w
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return results[order[i]].Penalty < results[order[j]].Penalty
+	})
+
+	p.Println("\nResults by chain:")
+	for rank, w := range order {
+		p.Printf("  %2d. chain %2d: %d\n", rank+1, chains[w].Number, int(results[w].Penalty))
+	}
+	best, worst, mean, stdDev := penaltySpread(results)
+	p.Printf("\n  Best: %d | Worst: %d | Mean: %d | Std dev: %d\n", int(best), int(worst), int(mean), int(stdDev))
+
+	return order[0]
+}
+
+func printChainStatuses(startTime time.Time, chains []parallelChain, iterations int, redraw bool) {
+	if redraw {
+		cursor.StartOfLineUp(len(chains))
+	}
+	for _, chain := range chains {
+		iteration, best, done := chain.Status.snapshot()
+		state := "running"
+		if done {
+			state = "done"
+		}
+		cursor.ClearLine()
+		p.Printf("  Chain %2d: %s | Iteration %d/%d | Best penalty: %d | %s (%s)\n",
+			chain.Number, generateProgressBar(float64(iteration)/float64(iterations)*100.0, 16),
+			iteration, iterations, int(best), state, time.Since(startTime).Round(time.Second))
+	}
+}
+
+// penaltySpread returns the best, worst, mean and standard deviation of the
+// penalties of a set of results.
+func penaltySpread(results []BestLayoutEntry) (float64, float64, float64, float64) {
+	if len(results) == 0 {
+		return 0, 0, 0, 0
+	}
+	best, worst, sum := math.Inf(1), math.Inf(-1), 0.0
+	for _, result := range results {
+		best = math.Min(best, result.Penalty)
+		worst = math.Max(worst, result.Penalty)
+		sum += result.Penalty
+	}
+	mean := sum / float64(len(results))
+	variance := 0.0
+	for _, result := range results {
+		variance += (result.Penalty - mean) * (result.Penalty - mean)
+	}
+	return best, worst, mean, math.Sqrt(variance / float64(len(results)))
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paretoArchiveSize is the most layouts kept on the front. When there are
+// more, the most crowded layout is dropped so the front stays spread out.
+const paretoArchiveSize = 100
+
+// otherRules is the objective made up of every rule that wasn't chosen.
+const otherRules = "Other rules"
+
+// ParetoEntry is a layout on the Pareto front and its score for each
+// objective.
+type ParetoEntry struct {
+	Objectives []float64
+	Keys       []Key
+}
+
+// ParetoArchive keeps the layouts that no other layout beats on every
+// objective. The objectives are the chosen penalty rules and the rest of the
+// rules together. Weights scale the objectives in the penalty that a chain
+// anneals on, so chains with different weights find different parts of the
+// front.
+type ParetoArchive struct {
+	Names   []string
+	Weights []float64
+	Entries []ParetoEntry
+}
+
+// NewParetoArchive checks the chosen rules are penalties the user pays and
+// returns an empty archive for them.
+func NewParetoArchive(names []string, user User) (*ParetoArchive, error) {
+	archive := &ParetoArchive{}
+	rules := InitPenaltyRules(user)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, rule := range rules {
+			if strings.EqualFold(rule.Name, name) {
+				if rule.Cost == 0 {
+					return nil, fmt.Errorf("rule %q has no cost in the user's penalties", rule.Name)
+				}
+				if slices.Contains(archive.Names, rule.Name) {
+					return nil, fmt.Errorf("rule %q is given more than once", rule.Name)
+				}
+				archive.Names = append(archive.Names, rule.Name)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown penalty rule %q", name)
+		}
+	}
+	archive.Names = append(archive.Names, otherRules)
+	archive.Weights = make([]float64, len(archive.Names))
+	for i := range archive.Weights {
+		archive.Weights[i] = 1.0
+	}
+	return archive, nil
+}
+
+// ForChain returns an empty archive for one of several parallel chains. The
+// first chain uses the user's penalties and the others weight each chosen rule
+// by a random factor between a quarter and four.
+func (archive *ParetoArchive) ForChain(chain int, rng *rand.Rand) *ParetoArchive {
+	if archive == nil {
+		return nil
+	}
+	chainArchive := &ParetoArchive{Names: archive.Names, Weights: make([]float64, len(archive.Weights))}
+	for i := range chainArchive.Weights {
+		chainArchive.Weights[i] = 1.0
+		if chain > 1 && i < len(archive.Weights)-1 {
+			chainArchive.Weights[i] = math.Pow(4, rng.Float64()*2-1)
+		}
+	}
+	return chainArchive
+}
+
+// dominates reports whether a is no worse than b on every objective and
+// better on at least one.
+func dominates(a, b []float64) bool {
+	better := false
+	for i := range a {
+		if a[i] > b[i] {
+			return false
+		}
+		if a[i] < b[i] {
+			better = true
+		}
+	}
+	return better
+}
+
+// Offer adds a layout to the archive if no layout in it is as good on every
+// objective, and drops the layouts it beats.
+func (archive *ParetoArchive) Offer(objectives []float64, layout *Layout) {
+	if !archive.accepts(objectives) {
+		return
+	}
+	archive.add(ParetoEntry{Objectives: append([]float64(nil), objectives...), Keys: layout.keyContents()})
+}
+
+// Merge adds the front of another archive to this one.
+func (archive *ParetoArchive) Merge(other *ParetoArchive) {
+	for _, entry := range other.Entries {
+		if archive.accepts(entry.Objectives) {
+			archive.add(entry)
+		}
+	}
+}
+
+func (archive *ParetoArchive) accepts(objectives []float64) bool {
+	for _, entry := range archive.Entries {
+		if dominates(entry.Objectives, objectives) || equalObjectives(entry.Objectives, objectives) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalObjectives(a, b []float64) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (archive *ParetoArchive) add(entry ParetoEntry) {
+	kept := archive.Entries[:0]
+	for _, existing := range archive.Entries {
+		if !dominates(entry.Objectives, existing.Objectives) {
+			kept = append(kept, existing)
+		}
+	}
+	archive.Entries = append(kept, entry)
+	if len(archive.Entries) > paretoArchiveSize {
+		archive.dropMostCrowded()
+	}
+}
+
+// dropMostCrowded removes the entry with the smallest crowding distance, as
+// NSGA-II measures it: the sum over the objectives of the gap between an
+// entry's neighbours, as a fraction of the objective's range across the front.
+// The entries at either end of an objective have an infinite distance so the
+// extent of the front is never lost.
+func (archive *ParetoArchive) dropMostCrowded() {
+	entries := archive.Entries
+	distances := make([]float64, len(entries))
+	order := make([]int, len(entries))
+	for i := range archive.Names {
+		for e := range order {
+			order[e] = e
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return entries[order[a]].Objectives[i] < entries[order[b]].Objectives[i]
+		})
+		first, last := order[0], order[len(order)-1]
+		distances[first], distances[last] = math.Inf(1), math.Inf(1)
+		low, high := entries[first].Objectives[i], entries[last].Objectives[i]
+		if high == low {
+			continue
+		}
+		for k := 1; k < len(order)-1; k++ {
+			distances[order[k]] += (entries[order[k+1]].Objectives[i] - entries[order[k-1]].Objectives[i]) / (high - low)
+		}
+	}
+
+	crowded := 0
+	for e := range distances {
+		if distances[e] < distances[crowded] {
+			crowded = e
+		}
+	}
+	archive.Entries = append(entries[:crowded], entries[crowded+1:]...)
+}
+
+// sort orders the front by the first objective.
+func (archive *ParetoArchive) sort() {
+	sort.SliceStable(archive.Entries, func(i, j int) bool {
+		return archive.Entries[i].Objectives[0] < archive.Entries[j].Objectives[0]
+	})
+}
+
+// Print shows the front as a table with a row per layout.
+func (archive *ParetoArchive) Print() {
+	archive.sort()
+	p.Printf("\nPareto front (%d layouts):\n", len(archive.Entries))
+	p.Printf("%4s", "#")
+	for _, name := range archive.Names {
+		p.Printf(" %20s", name)
+	}
+	p.Println()
+	for i, entry := range archive.Entries {
+		p.Printf("%4d", i+1)
+		for _, objective := range entry.Objectives {
+			p.Printf(" %20d", int(objective))
+		}
+		p.Println()
+	}
+}
+
+// Save writes each layout on the front to the pareto directory of the run,
+// numbered as in Print, with a CSV file of their scores.
+func (archive *ParetoArchive) Save(runDir string, layout Layout) error {
+	archive.sort()
+	dir := filepath.Join(runDir, "pareto")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("error creating pareto directory: %w", err)
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("layout," + strings.Join(archive.Names, ",") + "\n")
+	for i, entry := range archive.Entries {
+		front := layout.Duplicate()
+		if err := front.setKeyContents(entry.Keys); err != nil {
+			return err
+		}
+		front.Name = fmt.Sprintf("%s (pareto %d)", layout.Name, i+1)
+		filename := fmt.Sprintf("%d.json", i+1)
+		if err := front.Save(filepath.Join(dir, filename)); err != nil {
+			return err
+		}
+		sb.WriteString(filename)
+		for _, objective := range entry.Objectives {
+			sb.WriteString("," + strconv.FormatFloat(objective, 'f', -1, 64))
+		}
+		sb.WriteString("\n")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "front.csv"), []byte(sb.String()), 0o644); err != nil {
+		return fmt.Errorf("error writing pareto front: %w", err)
+	}
+	p.Printf("Saved the Pareto front to %s\n", dir)
+	return nil
+}
+
+// ParetoEvaluator scores each objective of an archive with its own
+// PenaltyEvaluator on its own copy of the layout, making every swap on all of
+// the copies. The penalty of a layout is the weighted sum of its objectives.
+type ParetoEvaluator struct {
+	archive    *ParetoArchive
+	evaluators []*PenaltyEvaluator
+	penalties  [][]KeyPenalty
+	scores     []float64
+}
+
+// NewParetoEvaluator splits the penalty rules into the archive's objectives
+// and takes ownership of the layout, as NewPenaltyEvaluator does.
+func NewParetoEvaluator(quartads QuartadList, layout *Layout, penaltyRules []KeyPenalty, archive *ParetoArchive) *ParetoEvaluator {
+	e := &ParetoEvaluator{
+		archive:    archive,
+		evaluators: make([]*PenaltyEvaluator, len(archive.Names)),
+		penalties:  make([][]KeyPenalty, len(archive.Names)),
+		scores:     make([]float64, len(archive.Names)),
+	}
+	other := len(archive.Names) - 1
+	for _, rule := range penaltyRules {
+		objective := other
+		for i, name := range archive.Names[:other] {
+			if rule.Name == name {
+				objective = i
+			}
+		}
+		e.penalties[objective] = append(e.penalties[objective], rule)
+	}
+	for i := range e.evaluators {
+		objectiveLayout := layout
+		if i > 0 {
+			copied := layout.Duplicate()
+			objectiveLayout = &copied
+		}
+		e.evaluators[i] = NewPenaltyEvaluator(quartads, objectiveLayout, &e.penalties[i])
+	}
+	return e
+}
+
+// Layout returns the layout being evaluated.
+func (e *ParetoEvaluator) Layout() *Layout {
+	return e.evaluators[0].Layout()
+}
+
+// Shuffle makes the same random swaps on every copy of the layout, skipping
+// swaps that would break a hard constraint.
+func (e *ParetoEvaluator) Shuffle(rng *rand.Rand, numSwaps int) {
+	first := e.evaluators[0]
+	if len(first.swappable) < 2 {
+		return
+	}
+	constrained := first.layout.hasHardConstraints()
+	for i := 0; i < numSwaps; i++ {
+		a, b := randomPair(rng, len(first.swappable))
+		if constrained && !first.meetsHardConstraints(first.swappable[a], first.swappable[b]) {
+			continue
+		}
+		for _, evaluator := range e.evaluators {
+			evaluator.Swap(evaluator.swappable[a], evaluator.swappable[b])
+		}
+	}
+}
+
+// Score returns the weighted sum of the objectives.
+func (e *ParetoEvaluator) Score() float64 {
+	total := 0.0
+	for i, evaluator := range e.evaluators {
+		e.scores[i] = evaluator.Score()
+		total += e.archive.Weights[i] * e.scores[i]
+	}
+	return total
+}
+
+// Objectives returns the score of each objective from the last Score.
+func (e *ParetoEvaluator) Objectives() []float64 {
+	return e.scores
+}
+
+// Commit accepts the swaps made since the last Commit or Revert.
+func (e *ParetoEvaluator) Commit() {
+	for _, evaluator := range e.evaluators {
+		evaluator.Commit()
+	}
+}
+
+// Revert undoes the swaps made since the last Commit or Revert.
+func (e *ParetoEvaluator) Revert() {
+	for _, evaluator := range e.evaluators {
+		evaluator.Revert()
+	}
+}
+
+// Results returns the weighted penalty with the results of every rule.
+func (e *ParetoEvaluator) Results() (float64, []KeyPenaltyResult) {
+	total := 0.0
+	var results []KeyPenaltyResult
+	for i, evaluator := range e.evaluators {
+		objective, objectiveResults := evaluator.Results()
+		total += e.archive.Weights[i] * objective
+		results = append(results, objectiveResults...)
+	}
+	return total, results
+}
@@ -1,15 +1,29 @@
 package main
 
+import "math"
+
 // KeyPenalty defines a penalty rule.
 type KeyPenalty struct {
 	Name             string
 	Function         PenaltyFunc
+	LayoutFunction   LayoutPenaltyFunc // Scores the whole layout rather than each quartad
+	LayerFunction    LayerPenaltyFunc  // Scores the layer keys needed to type each quartad
 	Cost             float64
 	WatermarkPenalty float64
 }
 
+// missingKeyCost is the penalty for each keypress of a rune that isn't on the
+// layout, far more than typing any key on it costs.
+const missingKeyCost = 100.0
+
 type PenaltyFunc func(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPhysicalInfo, cost float64) float64
 
+// LayerPenaltyFunc is given the keys of the last two runes and the layer keys
+// needed to type them, which are nil for runes on the base layer.
+type LayerPenaltyFunc func(curr, old1, layerCurr, layer1 *KeyPhysicalInfo, cost float64) float64
+
+type LayoutPenaltyFunc func(layout *Layout, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, cost float64) float64
+
 type KeyPenaltyResult struct {
 	Name             string
 	Total            float64
@@ -20,8 +34,9 @@ type KeyPenaltyResult struct {
 
 // InitPenaltyRules initializes the penalty rules.
 func InitPenaltyRules(user User) []KeyPenalty {
-	return []KeyPenalty{
+	rules := []KeyPenalty{
 		{Name: "Base", Function: calcBasePenalty, Cost: 1.0},
+		{Name: "Missing key", Function: calcMissingKeyPenalty, Cost: missingKeyCost},
 		{Name: "SFB", Function: calcSFBPenalty, Cost: user.Penalties.SFB},
 		{Name: "Vertical finger travel", Function: calcVerticalFingerTravelPenalty, Cost: user.Penalties.VerticalFingerTravel},
 		{Name: "Long SFB", Function: calcLongSFBPenalty, Cost: user.Penalties.LongSFB},
@@ -38,8 +53,14 @@ func InitPenaltyRules(user User) []KeyPenalty {
 		{Name: "Same finger modifier", Function: calcSameFingerModifierPenalty, Cost: user.Penalties.SameFingerModifier},
 		{Name: "Diagonal modifier", Function: calcDiagonalModifierPenalty, Cost: user.Penalties.DiagonalModifier},
 		{Name: "Modifier stretch", Function: calcModifierStretchPenalty, Cost: user.Penalties.ModifierStretch},
+		{Name: "Layer key", LayerFunction: calcLayerKeyPenalty, Cost: 1.0},
+		{Name: "Same finger layer key", LayerFunction: calcSameFingerLayerKeyPenalty, Cost: user.Penalties.SameFingerModifier},
 		{Name: "Double tap thumbs", Function: calcDoubleTapThumbsPenalty, Cost: user.Penalties.DoubleTapThumbs},
+		{Name: "Combo", Function: calcComboPenalty, Cost: user.Penalties.Combo},
+		{Name: "Combo clash", Function: calcComboClashPenalty, Cost: user.Penalties.ComboClash},
 	}
+	rules = append(rules, learningPenaltyRules(user)...)
+	return append(rules, constraintPenaltyRules(user.Layout.Constraints)...)
 }
 
 func calcBasePenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPhysicalInfo, cost float64) float64 {
@@ -49,12 +70,21 @@ func calcBasePenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPhysi
 	return curr.cost * cost
 }
 
+// calcMissingKeyPenalty charges for typing a rune that isn't on the layout.
+// Only single rune quartads are built for those runes.
+func calcMissingKeyPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPhysicalInfo, cost float64) float64 {
+	if curr == nil && old1 == nil {
+		return cost
+	}
+	return 0.0
+}
+
 func calcSFBPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPhysicalInfo, cost float64) float64 {
 	if curr == nil || old1 == nil {
 		return 0.0
 	}
 	if curr.hand == old1.hand && curr.associatedFinger == old1.associatedFinger {
-		if curr.key != old1.key {
+		if !samePhysicalKey(curr, old1) {
 			return cost
 		}
 	}
@@ -66,8 +96,7 @@ func calcVerticalFingerTravelPenalty(curr, old1, old2, old3, modCurr, mod1, mod2
 		return 0.0
 	}
 	if curr.hand == old1.hand {
-		delta := AbsI(curr.row - old1.row)
-		if delta >= 2 {
+		if verticalDistance(curr, old1) >= 2-geometryTolerance {
 			return cost
 		}
 	}
@@ -79,8 +108,7 @@ func calcLongSFBPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPh
 		return 0.0
 	}
 	if curr.hand == old1.hand && curr.associatedFinger == old1.associatedFinger {
-		delta := AbsI(curr.row - old1.row)
-		if delta >= 2 {
+		if keyDistance(curr, old1) >= 2-geometryTolerance {
 			return cost
 		}
 	}
@@ -95,8 +123,8 @@ func calcLateralStretchPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3
 	// Check if both keys were pressed by the same hand and there is a long jump between rows
 	if curr.hand == old1.hand {
 		// Check if there's a vertical jump between the top and bottom rows
-		if (curr.vertDeltaToHome < 0 && old1.vertDeltaToHome > 0) ||
-			(curr.vertDeltaToHome > 0 && old1.vertDeltaToHome < 0) {
+		if (rowFromHome(curr) < 0 && rowFromHome(old1) > 0) ||
+			(rowFromHome(curr) > 0 && rowFromHome(old1) < 0) {
 
 			// Check for specific finger combinations that are penalized
 			if (curr.associatedFinger == Ring && old1.associatedFinger == Pinkie) ||
@@ -105,7 +133,7 @@ func calcLateralStretchPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3
 				(curr.associatedFinger == Ring && old1.associatedFinger == Middle) ||
 				(curr.associatedFinger == Index &&
 					(old1.associatedFinger == Middle || old1.associatedFinger == Ring) &&
-					curr.vertDeltaToHome < 0 && old1.vertDeltaToHome > 0) {
+					rowFromHome(curr) < 0 && rowFromHome(old1) > 0) {
 				// Apply the penalty
 				return cost
 			}
@@ -121,11 +149,11 @@ func calcPinkyRingStretchPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mo
 	}
 	if curr.hand == old1.hand {
 		if curr.associatedFinger == Pinkie && old1.associatedFinger == Ring {
-			if curr.row < old1.row {
+			if rowFromHome(curr) < rowFromHome(old1) {
 				return cost
 			}
 		} else if curr.associatedFinger == Ring && old1.associatedFinger == Pinkie {
-			if curr.row < old1.row {
+			if rowFromHome(curr) < rowFromHome(old1) {
 				return cost
 			}
 		}
@@ -199,9 +227,11 @@ func calcScissorMotionPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3
 	}
 	if curr.hand == old1.hand {
 		// Penalize scissor-like motion (e.g., ring finger and index finger pressing on opposite rows)
-		if (curr.associatedFinger == Ring && old1.associatedFinger == Index && curr.row != old1.row) ||
-			(curr.associatedFinger == Index && old1.associatedFinger == Ring && curr.row != old1.row) {
-			return cost
+		if (curr.associatedFinger == Ring && old1.associatedFinger == Index) ||
+			(curr.associatedFinger == Index && old1.associatedFinger == Ring) {
+			if math.Abs(curr.yToHome-old1.yToHome) >= 1-geometryTolerance {
+				return cost
+			}
 		}
 	}
 	return 0.0
@@ -214,8 +244,8 @@ func calcRowChangeInRollPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod
 
 	if curr.hand == old1.hand && curr.hand == old2.hand {
 		// Check if the row movement spans all three rows (Top -> Home -> Bottom or Bottom -> Home -> Top)
-		if (curr.vertDeltaToHome < 0 && old1.vertDeltaToHome == 0 && old2.vertDeltaToHome > 0) ||
-			(curr.vertDeltaToHome > 0 && old1.vertDeltaToHome == 0 && old2.vertDeltaToHome < 0) {
+		if (rowFromHome(curr) < 0 && rowFromHome(old1) == 0 && rowFromHome(old2) > 0) ||
+			(rowFromHome(curr) > 0 && rowFromHome(old1) == 0 && rowFromHome(old2) < 0) {
 
 			// Check if the movement is a roll out or roll in
 			if (isRollOut(curr.associatedFinger, old1.associatedFinger) && isRollOut(old1.associatedFinger, old2.associatedFinger)) ||
@@ -254,8 +284,7 @@ func calcDiagonalModifierPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mo
 		return 0.0
 	}
 	if curr.hand == modCurr.hand {
-		vDelta := AbsI(modCurr.row - curr.row)
-		if vDelta > 2 {
+		if verticalDistance(modCurr, curr) > 2+geometryTolerance {
 			return cost
 		}
 	}
@@ -271,8 +300,7 @@ func calcModifierStretchPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod
 		if (curr.associatedFinger == Pinkie && modCurr.associatedFinger == Index) ||
 			(curr.associatedFinger == Index && modCurr.associatedFinger == Pinkie) {
 			// Check if both are away from their home positions
-			if (curr.horzDeltaToHome != 0 || curr.vertDeltaToHome != 0) &&
-				(modCurr.horzDeltaToHome != 0 || modCurr.vertDeltaToHome != 0) {
+			if awayFromHome(curr) && awayFromHome(modCurr) {
 				return cost
 			}
 		}
@@ -280,6 +308,36 @@ func calcModifierStretchPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod
 	return 0.0
 }
 
+// calcLayerKeyPenalty charges for pressing the layer key of a rune on another
+// layer. A momentary layer key is held for every rune on its layer and a
+// one-shot layer key is tapped before each of them. A toggle layer key is only
+// tapped when the layer changes, once to enter the layer and once to leave it.
+func calcLayerKeyPenalty(curr, old1, layerCurr, layer1 *KeyPhysicalInfo, cost float64) float64 {
+	penalty := 0.0
+	if layerCurr != nil && (layerCurr.activation != Toggle || (old1 != nil && layer1 != layerCurr)) {
+		penalty += layerCurr.cost * cost
+	}
+	if curr != nil && layer1 != nil && layer1.activation == Toggle && layer1 != layerCurr {
+		penalty += layer1.cost * cost
+	}
+	return penalty
+}
+
+// calcSameFingerLayerKeyPenalty charges for pressing a rune with the finger
+// that presses its layer key, whether holding it or having just tapped it.
+func calcSameFingerLayerKeyPenalty(curr, old1, layerCurr, layer1 *KeyPhysicalInfo, cost float64) float64 {
+	if curr == nil || layerCurr == nil {
+		return 0.0
+	}
+	if layerCurr.activation == Toggle && (old1 == nil || layer1 == layerCurr) {
+		return 0.0
+	}
+	if curr.hand == layerCurr.hand && curr.associatedFinger == layerCurr.associatedFinger {
+		return cost
+	}
+	return 0.0
+}
+
 func calcDoubleTapThumbsPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPhysicalInfo, cost float64) float64 {
 	if curr == nil || old1 == nil {
 		return 0.0
@@ -292,8 +350,47 @@ func calcDoubleTapThumbsPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod
 	return 0.0
 }
 
+// calcComboPenalty charges for every finger a combo needs, as keys pressed
+// together take more effort and timing than a single key.
+func calcComboPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPhysicalInfo, cost float64) float64 {
+	if curr == nil || !isCombo(curr) {
+		return 0.0
+	}
+	return float64(comboFingers(curr)) * cost
+}
+
+// calcComboClashPenalty penalizes a combo next to a key that needs one of the
+// same fingers, which must be lifted and moved in time for the next press.
+func calcComboClashPenalty(curr, old1, old2, old3, modCurr, mod1, mod2, mod3 *KeyPhysicalInfo, cost float64) float64 {
+	if curr == nil || old1 == nil || curr == old1 {
+		return 0.0
+	}
+	if !isCombo(curr) && !isCombo(old1) {
+		return 0.0
+	}
+	for _, a := range pressedKeys(curr) {
+		for _, b := range pressedKeys(old1) {
+			if a.hand == b.hand && a.associatedFinger == b.associatedFinger {
+				return cost
+			}
+		}
+	}
+	return 0.0
+}
+
 // CalculatePenalty calculates the total penalty for a layout and the given quartads.
 func CalculatePenalty(quartads QuartadList, layout Layout, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, penalties *[]KeyPenalty) (float64, []KeyPenaltyResult) {
+	return calculatePenalty(quartads, layout, runesToKeyPhysicalKeyInfoMap, penalties, optDebug)
+}
+
+// CalculatePenaltyDetailed is CalculatePenalty but always records the per-rule
+// totals and the penalty of every quartad in the results, whatever the debug
+// level.
+func CalculatePenaltyDetailed(quartads QuartadList, layout Layout, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, penalties *[]KeyPenalty) (float64, []KeyPenaltyResult) {
+	return calculatePenalty(quartads, layout, runesToKeyPhysicalKeyInfoMap, penalties, 3)
+}
+
+func calculatePenalty(quartads QuartadList, layout Layout, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, penalties *[]KeyPenalty, detail int) (float64, []KeyPenaltyResult) {
 	var totalPenalty float64
 	results := make([]KeyPenaltyResult, len(*penalties))
 
@@ -307,11 +404,21 @@ func CalculatePenalty(quartads QuartadList, layout Layout, runesToKeyPhysicalKey
 	}
 
 	for quartad, count := range quartads {
-		penalty := penalize(quartad, count, runesToKeyPhysicalKeyInfoMap, results)
+		penalty := penalize(quartad, count, runesToKeyPhysicalKeyInfoMap, results, detail)
 		totalPenalty += penalty
 	}
 
-	if optDebug > 0 {
+	for i, penalty := range *penalties {
+		if penalty.LayoutFunction != nil && penalty.Cost != 0 {
+			cost := penalty.LayoutFunction(&layout, runesToKeyPhysicalKeyInfoMap, penalty.Cost)
+			totalPenalty += cost
+			if detail > 0 {
+				results[i].Total += cost
+			}
+		}
+	}
+
+	if detail > 0 {
 		for i, result := range results {
 			if result.Info.Cost > 0 {
 				if (*penalties)[i].WatermarkPenalty < result.Total {
@@ -363,29 +470,60 @@ func isRollIn(currFinger, prevFinger Finger) bool {
 	}
 }
 
-// calculateQuartadPenalty calculates the penalty for a given quartad.
-func penalize(quartad Quartad, count int, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, penalties []KeyPenaltyResult) float64 {
-	total := 0.0
+// quartadKeys holds the keys pressed to type a quartad: the key of each rune,
+// its modifier and the layer key needed to reach the last two.
+type quartadKeys struct {
+	curr, old1, old2, old3    *KeyPhysicalInfo
+	modCurr, mod1, mod2, mod3 *KeyPhysicalInfo
+	layerCurr, layer1         *KeyPhysicalInfo
+}
 
-	// Get current rune key press information
-	curr := getKey(quartad, 0, runesToKeyPhysicalKeyInfoMap)
-	old1 := getKey(quartad, 1, runesToKeyPhysicalKeyInfoMap)
-	old2 := getKey(quartad, 2, runesToKeyPhysicalKeyInfoMap)
-	old3 := getKey(quartad, 3, runesToKeyPhysicalKeyInfoMap)
-	modCurr := getModifier(quartad, 0, runesToKeyPhysicalKeyInfoMap)
-	mod1 := getModifier(quartad, 1, runesToKeyPhysicalKeyInfoMap)
-	mod2 := getModifier(quartad, 2, runesToKeyPhysicalKeyInfoMap)
-	mod3 := getModifier(quartad, 3, runesToKeyPhysicalKeyInfoMap)
+func getQuartadKeys(quartad Quartad, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo) quartadKeys {
+	keys := quartadKeys{
+		curr:    getKey(quartad, 0, runesToKeyPhysicalKeyInfoMap),
+		old1:    getKey(quartad, 1, runesToKeyPhysicalKeyInfoMap),
+		old2:    getKey(quartad, 2, runesToKeyPhysicalKeyInfoMap),
+		old3:    getKey(quartad, 3, runesToKeyPhysicalKeyInfoMap),
+		modCurr: getModifier(quartad, 0, runesToKeyPhysicalKeyInfoMap),
+		mod1:    getModifier(quartad, 1, runesToKeyPhysicalKeyInfoMap),
+		mod2:    getModifier(quartad, 2, runesToKeyPhysicalKeyInfoMap),
+		mod3:    getModifier(quartad, 3, runesToKeyPhysicalKeyInfoMap),
+	}
+	keys.layerCurr = getLayerKey(keys.curr, runesToKeyPhysicalKeyInfoMap)
+	keys.layer1 = getLayerKey(keys.old1, runesToKeyPhysicalKeyInfoMap)
+	return keys
+}
+
+// scoreRule calculates the penalty of one rule for a quartad typed count
+// times. Both penalize and scoreQuartad score every rule with it, so that
+// incremental scoring gives the same totals as CalculatePenalty.
+func scoreRule(penalty *KeyPenalty, keys *quartadKeys, count int) float64 {
+	cost := 0.0
+	if penalty.Function != nil {
+		cost += penalty.Function(keys.curr, keys.old1, keys.old2, keys.old3, keys.modCurr, keys.mod1, keys.mod2, keys.mod3, penalty.Cost) * float64(count)
+	}
+	if penalty.LayerFunction != nil {
+		cost += penalty.LayerFunction(keys.curr, keys.old1, keys.layerCurr, keys.layer1, penalty.Cost) * float64(count)
+	}
+	return cost
+}
+
+// penalize calculates the penalty for a given quartad and adds each rule's
+// share to its result.
+func penalize(quartad Quartad, count int, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, penalties []KeyPenaltyResult, detail int) float64 {
+	total := 0.0
+	keys := getQuartadKeys(quartad, runesToKeyPhysicalKeyInfoMap)
 
 	for i, penalty := range penalties {
-		if penalty.Info.Cost != 0 {
-			cost := penalty.Info.Function(curr, old1, old2, old3, modCurr, mod1, mod2, mod3, penalty.Info.Cost) * float64(count)
-			total += cost
-			if optDebug > 0 {
-				penalties[i].Total += cost
-				if optDebug > 2 {
-					penalties[i].HighKeys[quartad] += cost
-				}
+		if penalty.Info.Cost == 0 {
+			continue
+		}
+		cost := scoreRule(penalty.Info, &keys, count)
+		total += cost
+		if detail > 0 {
+			penalties[i].Total += cost
+			if detail > 2 && cost != 0 {
+				penalties[i].HighKeys[quartad] += cost
 			}
 		}
 	}
@@ -393,6 +531,34 @@ func penalize(quartad Quartad, count int, runesToKeyPhysicalKeyInfoMap map[rune]
 	return total
 }
 
+// scoreQuartad calculates the penalty for a single quartad without recording
+// per-rule results.
+func scoreQuartad(quartad Quartad, count int, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, penalties []KeyPenalty) float64 {
+	total := 0.0
+	keys := getQuartadKeys(quartad, runesToKeyPhysicalKeyInfoMap)
+
+	for i := range penalties {
+		if penalties[i].Cost == 0 {
+			continue
+		}
+		total += scoreRule(&penalties[i], &keys, count)
+	}
+
+	return total
+}
+
+// scoreLayout calculates the penalties that score the whole layout rather
+// than each quartad.
+func scoreLayout(layout *Layout, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo, penalties []KeyPenalty) float64 {
+	total := 0.0
+	for _, penalty := range penalties {
+		if penalty.LayoutFunction != nil && penalty.Cost != 0 {
+			total += penalty.LayoutFunction(layout, runesToKeyPhysicalKeyInfoMap, penalty.Cost)
+		}
+	}
+	return total
+}
+
 // getKey returns the key press information from the layout.
 func getKey(quartad Quartad, reverseIndex int, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo) *KeyPhysicalInfo {
 	index := quartad.Len() - (reverseIndex + 1)
@@ -405,9 +571,23 @@ func getKey(quartad Quartad, reverseIndex int, runesToKeyPhysicalKeyInfoMap map[
 
 func getModifier(quartad Quartad, reverseIndex int, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo) *KeyPhysicalInfo {
 	index := quartad.Len() - (reverseIndex + 1)
-	if index <= 0 || reverseIndex < 0 {
+	if index < 0 || reverseIndex < 0 {
+		return nil
+	}
+	modifier := quartad.GetModifier(index)
+	// The Shift of the first rune is charged in the longer quartads that end
+	// with it. A shortcut can be a single chord, so Ctrl and Alt always are.
+	if index == 0 && modifier != CtrlModifier && modifier != AltModifier {
+		return nil
+	}
+	return runesToKeyPhysicalKeyInfoMap[rune(modifier)]
+}
+
+// getLayerKey returns the layer key needed to type a key on another layer, or
+// nil for keys on the base layer. It is needed as well as any modifier.
+func getLayerKey(keyInfo *KeyPhysicalInfo, runesToKeyPhysicalKeyInfoMap map[rune]*KeyPhysicalInfo) *KeyPhysicalInfo {
+	if keyInfo == nil || keyInfo.layer == 0 {
 		return nil
 	}
-	m := rune(quartad.GetModifier(index))
-	return runesToKeyPhysicalKeyInfoMap[m]
+	return runesToKeyPhysicalKeyInfoMap[layerRune(keyInfo.layer)]
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// layerTestKeys returns a key map with a Shift key, a layer key reaching
+// layer 1 with the given activation, the runes a and A on layer 1 and x on the
+// base layer.
+func layerTestKeys(activation string) map[rune]*KeyPhysicalInfo {
+	side := &Side{}
+	shift := &KeyPhysicalInfo{key: &Key{}, hand: side, associatedFinger: Pinkie, cost: 2}
+	layerKey := &KeyPhysicalInfo{key: &Key{}, hand: side, associatedFinger: Thumb, cost: 3, activation: activation}
+	onLayer := &KeyPhysicalInfo{key: &Key{UnshiftedRune: 'a', ShiftedRune: 'A'}, hand: side, associatedFinger: Index, cost: 1.5, layer: 1}
+	onBase := &KeyPhysicalInfo{key: &Key{UnshiftedRune: 'x', ShiftedRune: 'X'}, hand: side, associatedFinger: Middle, cost: 1, col: 1}
+	return map[rune]*KeyPhysicalInfo{
+		rune(ShiftModifier): shift,
+		layerRune(1):        layerKey,
+		'a':                 onLayer,
+		'A':                 onLayer,
+		'x':                 onBase,
+		'X':                 onBase,
+	}
+}
+
+func TestShiftedRuneOnLayerPaysForBoth(t *testing.T) {
+	rules := InitPenaltyRules(User{})
+	shifted := map[rune]int{'A': 1, 'X': 1}
+
+	for _, activation := range []string{Momentary, OneShot} {
+		keyMap := layerTestKeys(activation)
+		tests := []struct {
+			quartad string
+			want    float64
+		}{
+			{"x", 1},            // Base layer key
+			{"X", 1},            // The first rune's Shift isn't charged
+			{"xX", 1 + 2},       // Shift
+			{"a", 1.5 + 3},      // Layer key
+			{"A", 1.5 + 3},      // The layer key but not the first rune's Shift
+			{"aA", 1.5 + 2 + 3}, // The layer key is needed for every rune
+			{"xa", 1.5 + 3},     // Entering the layer
+			{"ax", 1},           // Leaving the layer
+		}
+		for _, test := range tests {
+			got := scoreQuartad(MakeQuartad(test.quartad, shifted), 1, keyMap, rules)
+			if math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("%s layer: penalty of %q = %g, want %g", activation, test.quartad, got, test.want)
+			}
+		}
+	}
+}
+
+func TestToggleLayerKeyOnlyTappedWhenLayerChanges(t *testing.T) {
+	rules := InitPenaltyRules(User{})
+	shifted := map[rune]int{'A': 1, 'X': 1}
+	keyMap := layerTestKeys(Toggle)
+
+	tests := []struct {
+		quartad string
+		want    float64
+	}{
+		{"a", 1.5},          // Whether the layer is on isn't known
+		{"A", 1.5},          // Nor is the first rune's Shift charged
+		{"aA", 1.5 + 2},     // Already on the layer
+		{"xa", 1.5 + 3},     // Tapped to enter the layer
+		{"xA", 1.5 + 2 + 3}, // Tapped to enter the layer as well as Shift
+		{"ax", 1 + 3},       // Tapped to leave the layer
+		{"aX", 1 + 2 + 3},   // Tapped to leave the layer as well as Shift
+	}
+	for _, test := range tests {
+		got := scoreQuartad(MakeQuartad(test.quartad, shifted), 1, keyMap, rules)
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("penalty of %q = %g, want %g", test.quartad, got, test.want)
+		}
+	}
+}
+
+func TestSingleChordShortcutChargesItsModifier(t *testing.T) {
+	rules := InitPenaltyRules(User{})
+	keyMap := layerTestKeys(Momentary)
+	keyMap[rune(CtrlModifier)] = &KeyPhysicalInfo{key: &Key{}, hand: keyMap['x'].hand, associatedFinger: Pinkie, cost: 2}
+
+	var shortcut Quartad
+	addRuneToQuartad(&shortcut, 'x', CtrlModifier)
+	if got, want := scoreQuartad(shortcut, 1, keyMap, rules), 1.0+2; math.Abs(got-want) > 1e-9 {
+		t.Errorf("penalty of ctrl+x = %g, want %g", got, want)
+	}
+}
+
+func TestPinkyRingStretchOnStaggeredColumns(t *testing.T) {
+	layout := readTestUser(t, "zsa-voyager").Layout
+	pinky := func(row int) *KeyPhysicalInfo { return &layout.Left.Rows[row][1] }
+	ring := func(row int) *KeyPhysicalInfo { return &layout.Left.Rows[row][2] }
+
+	tests := []struct {
+		name       string
+		curr, old1 *KeyPhysicalInfo
+		want       float64
+	}{
+		{"pinky then ring in the same row", ring(1), pinky(1), 0},
+		{"ring then pinky in the same row", pinky(1), ring(1), 0},
+		{"pinky on the home row then ring above", ring(1), pinky(2), 1},
+		{"ring on the home row then pinky above", pinky(1), ring(2), 1},
+		{"ring above then pinky on the home row", pinky(2), ring(1), 0},
+	}
+	for _, test := range tests {
+		if got := calcPinkyRingStretchPenalty(test.curr, test.old1, nil, nil, nil, nil, nil, nil, 1); got != test.want {
+			t.Errorf("%s: penalty %g, want %g", test.name, got, test.want)
+		}
+	}
+}
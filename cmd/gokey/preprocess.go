@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// The preprocessors that can be given for a corpus entry. Code selects all of
+// them but brackets.
+const (
+	PreprocessIndent    = "indent"    // Drop the indentation editors add
+	PreprocessLicense   = "license"   // Drop a header comment with copyright or license text
+	PreprocessGenerated = "generated" // Skip walked files marked as generated
+	PreprocessHex       = "hex"       // Drop long hex literals and hashes
+	PreprocessBrackets  = "brackets"  // Drop closing brackets editors add
+	PreprocessCode      = "code"
+)
+
+const (
+	generatedCheckSize = 16 << 10 // How far into a file to look for a generated marker, and the longest line held whole
+	licenseBlockLimit  = 1000     // Longest comment block held back to check for a license
+	bracketDepthLimit  = 1000     // Most open brackets remembered
+)
+
+var (
+	generatedPattern = regexp.MustCompile(`(?m)^\s*(//|#|--)\s*Code generated .* DO NOT EDIT\.|@generated|<auto-generated`)
+	licensePattern   = regexp.MustCompile(`(?i)copyright|licensed under|spdx-license-identifier`)
+	hexPattern       = regexp.MustCompile(`\b0[xX][0-9a-fA-F_]{5,}\b|\b[0-9a-fA-F]{16,}\b`)
+)
+
+// commentSyntax is how comments are written in a language.
+type commentSyntax struct {
+	line       []string
+	blockStart string
+	blockEnd   string
+}
+
+var (
+	cComments     = commentSyntax{line: []string{"//"}, blockStart: "/*", blockEnd: "*/"}
+	hashComments  = commentSyntax{line: []string{"#"}}
+	dashComments  = commentSyntax{line: []string{"--"}}
+	otherComments = commentSyntax{line: []string{"//", "#", "--"}, blockStart: "/*", blockEnd: "*/"}
+
+	// languageComments maps file extensions to the comments of their
+	// language. Files with other extensions, like a corpus of code joined into
+	// a text file, accept any of them.
+	languageComments = map[string]commentSyntax{
+		".go": cComments, ".c": cComments, ".h": cComments, ".cc": cComments, ".cpp": cComments,
+		".hpp": cComments, ".java": cComments, ".js": cComments, ".jsx": cComments, ".ts": cComments,
+		".tsx": cComments, ".rs": cComments, ".swift": cComments, ".kt": cComments, ".cs": cComments,
+		".scala": cComments, ".dart": cComments, ".php": cComments, ".zig": cComments,
+		".py": hashComments, ".sh": hashComments, ".bash": hashComments, ".zsh": hashComments,
+		".rb": hashComments, ".pl": hashComments, ".r": hashComments, ".yaml": hashComments,
+		".yml": hashComments, ".toml": hashComments, ".mk": hashComments,
+		".lua": dashComments, ".sql": dashComments, ".hs": dashComments,
+	}
+)
+
+// validatePreprocessors checks the names of a corpus entry's preprocessors.
+func validatePreprocessors(names []string) error {
+	for _, name := range names {
+		switch name {
+		case PreprocessIndent, PreprocessLicense, PreprocessGenerated, PreprocessHex, PreprocessBrackets, PreprocessCode:
+		default:
+			return fmt.Errorf("unknown preprocessor %q, expected %s, %s, %s, %s, %s or %s", name,
+				PreprocessIndent, PreprocessLicense, PreprocessGenerated, PreprocessHex, PreprocessBrackets, PreprocessCode)
+		}
+	}
+	return nil
+}
+
+func hasPreprocessor(names []string, name string) bool {
+	for _, n := range names {
+		if n == name || (n == PreprocessCode && name != PreprocessBrackets) {
+			return true
+		}
+	}
+	return false
+}
+
+// preprocessor rewrites a file a line at a time as it's read.
+type preprocessor struct {
+	in       *bufio.Reader
+	names    []string
+	comments commentSyntax
+	pending  []byte
+	err      error
+
+	// Whether the last chunk read was part of a line too long to hold whole
+	continued bool
+
+	// The file's header comment, held back until it's known whether it's a
+	// license, and whether the header has been passed
+	block      []string
+	inBlock    bool
+	pastHeader bool
+
+	// The brackets opened and not yet closed
+	open []rune
+}
+
+// preprocess returns a reader of the file after the preprocessors, or nil if
+// the whole file is skipped.
+func preprocess(r io.Reader, file corpusFile) io.Reader {
+	if len(file.Preprocess) == 0 {
+		return r
+	}
+	comments, ok := languageComments[strings.ToLower(path.Ext(file.Path))]
+	if !ok {
+		comments = otherComments
+	}
+
+	// Only a file read on its own is skipped, as a file of joined sources
+	// would be skipped whole for one generated file in it
+	in := bufio.NewReaderSize(r, generatedCheckSize)
+	if file.Walked && hasPreprocessor(file.Preprocess, PreprocessGenerated) {
+		head, _ := in.Peek(generatedCheckSize)
+		if generatedPattern.MatchString(leadingComment(head, comments)) {
+			reportSkipped(file.Path)
+			return nil
+		}
+	}
+
+	return &preprocessor{in: in, names: file.Preprocess, comments: comments}
+}
+
+// leadingComment returns the comment at the start of a file, which is where
+// generated files are marked.
+func leadingComment(head []byte, comments commentSyntax) string {
+	pp := preprocessor{comments: comments}
+	var sb strings.Builder
+	for _, line := range strings.SplitAfter(string(head), "\n") {
+		if strings.TrimSpace(line) != "" && !pp.isComment(line) {
+			break
+		}
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
+
+// skippedFiles holds the generated files already reported, as the corpus is
+// read more than once.
+var skippedFiles sync.Map
+
+func reportSkipped(filename string) {
+	if _, reported := skippedFiles.LoadOrStore(filename, true); !reported {
+		p.Printf("Skipping generated file %s\n", filename)
+	}
+}
+
+func (pp *preprocessor) Read(buf []byte) (int, error) {
+	for len(pp.pending) == 0 {
+		if pp.err != nil {
+			return 0, pp.err
+		}
+		// Lines longer than the buffer are passed on in chunks, so a minified
+		// file never has to fit in memory
+		chunk, err := pp.in.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			pp.pending = append(pp.pending, pp.longLine(string(chunk))...)
+			pp.continued = true
+			continue
+		}
+		pp.err = err
+		if len(chunk) > 0 {
+			if pp.continued {
+				pp.pending = append(pp.pending, pp.longLine(string(chunk))...)
+			} else {
+				pp.pending = append(pp.pending, pp.line(string(chunk))...)
+			}
+		}
+		pp.continued = false
+		if err != nil {
+			pp.pending = append(pp.pending, pp.flushBlock()...)
+		}
+	}
+	n := copy(buf, pp.pending)
+	pp.pending = pp.pending[n:]
+	return n, nil
+}
+
+// line returns what is left of a line after the preprocessors.
+func (pp *preprocessor) line(line string) string {
+	var out string
+	if hasPreprocessor(pp.names, PreprocessLicense) && !pp.pastHeader {
+		if pp.isComment(line) {
+			pp.block = append(pp.block, line)
+			if len(pp.block) < licenseBlockLimit {
+				return ""
+			}
+			pp.pastHeader = true
+			return pp.flushBlock()
+		}
+		if len(pp.block) == 0 && strings.TrimSpace(line) == "" {
+			return pp.edit(line, true)
+		}
+		// The header is the first comment block, so later comments stay
+		pp.pastHeader = true
+		out = pp.flushBlock()
+	}
+
+	return out + pp.edit(line, true)
+}
+
+// longLine returns a chunk of a line too long to hold whole after the
+// preprocessors. Such a line ends the header, and only its first chunk has
+// indentation to drop.
+func (pp *preprocessor) longLine(chunk string) string {
+	var out string
+	if !pp.pastHeader {
+		pp.pastHeader = true
+		out = pp.flushBlock()
+	}
+	return out + pp.edit(chunk, !pp.continued)
+}
+
+// isComment reports whether a line is part of a comment, following block
+// comments from line to line.
+func (pp *preprocessor) isComment(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	if pp.inBlock {
+		pp.inBlock = !strings.Contains(trimmed, pp.comments.blockEnd)
+		return true
+	}
+	if pp.comments.blockStart != "" && strings.HasPrefix(trimmed, pp.comments.blockStart) {
+		pp.inBlock = !strings.Contains(trimmed[len(pp.comments.blockStart):], pp.comments.blockEnd)
+		return true
+	}
+	for _, prefix := range pp.comments.line {
+		if strings.HasPrefix(trimmed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// flushBlock drops the held back header comment if it's a license and
+// otherwise returns it edited.
+func (pp *preprocessor) flushBlock() string {
+	block := pp.block
+	pp.block = nil
+	if len(block) == 0 || licensePattern.MatchString(strings.Join(block, "")) {
+		return ""
+	}
+	var sb strings.Builder
+	for _, line := range block {
+		sb.WriteString(pp.edit(line, true))
+	}
+	return sb.String()
+}
+
+// edit applies the preprocessors that change the text of a line, or of part
+// of one that doesn't start the line.
+func (pp *preprocessor) edit(line string, lineStart bool) string {
+	if hasPreprocessor(pp.names, PreprocessHex) {
+		line = hexPattern.ReplaceAllString(line, "")
+	}
+	if lineStart && hasPreprocessor(pp.names, PreprocessIndent) {
+		line = strings.TrimLeft(line, " \t")
+	}
+	if hasPreprocessor(pp.names, PreprocessBrackets) {
+		line = pp.dropClosingBrackets(line)
+	}
+	return line
+}
+
+// dropClosingBrackets removes the brackets that close one opened earlier in
+// the file, as an editor adds those when the opening bracket is typed. Other
+// bytes are kept as they are, so a rune split between chunks of a long line
+// isn't lost.
+func (pp *preprocessor) dropClosingBrackets(line string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(line); {
+		r, size := utf8.DecodeRuneInString(line[i:])
+		text := line[i : i+size]
+		i += size
+		switch r {
+		case '(', '[', '{':
+			if len(pp.open) == bracketDepthLimit {
+				pp.open = pp.open[1:]
+			}
+			pp.open = append(pp.open, r)
+		case ')', ']', '}':
+			if n := len(pp.open); n > 0 && pp.open[n-1] == openingBracket(r) {
+				pp.open = pp.open[:n-1]
+				continue
+			}
+		}
+		buf.WriteString(text)
+	}
+	return buf.String()
+}
+
+func openingBracket(r rune) rune {
+	switch r {
+	case ')':
+		return '('
+	case ']':
+		return '['
+	}
+	return '{'
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cobra"
+)
+
+var qmkCmd = &cobra.Command{
+	Use:   "qmk [username] [keyboard]",
+	Short: "Export a layout as a QMK keymap.c.",
+	Long: `Export a fully specified keyboard layout as a QMK keymap.c. The keyboard file
+must have a "qmk" section giving the LAYOUT macro and the order of its keys.
+Keycodes assume the computer uses a US layout, with the user's locale saying
+which symbols need shift.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run:  exportQMK,
+}
+
+func init() {
+	exportCmd.AddCommand(qmkCmd)
+}
+
+// QMK describes the LAYOUT macro of a QMK keyboard. Each entry in Keys is a
+// key position like "L2,3" or a QMK keycode for a key gokey doesn't model,
+// with one row of entries for each line of the macro.
+type QMK struct {
+	Layout string     `json:"layout"`
+	Keys   [][]string `json:"keys"`
+}
+
+var qmkKeycodes = map[rune]string{
+	' ':  "KC_SPC",
+	'\n': "KC_ENT",
+	'\t': "KC_TAB",
+	'\b': "KC_BSPC",
+	'-':  "KC_MINS",
+	'=':  "KC_EQL",
+	'[':  "KC_LBRC",
+	']':  "KC_RBRC",
+	'\\': "KC_BSLS",
+	';':  "KC_SCLN",
+	'\'': "KC_QUOT",
+	'`':  "KC_GRV",
+	',':  "KC_COMM",
+	'.':  "KC_DOT",
+	'/':  "KC_SLSH",
+	'§':  "KC_NUBS",
+}
+
+// qmkModifiers gives the left and right keycodes of each modifier.
+var qmkModifiers = map[Modifier][2]string{
+	ShiftModifier: {"KC_LSFT", "KC_RSFT"},
+	CtrlModifier:  {"KC_LCTL", "KC_RCTL"},
+	AltModifier:   {"KC_LALT", "KC_RALT"},
+}
+
+func exportQMK(cmd *cobra.Command, args []string) {
+	user, err := readExportLayout(args)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	source, err := user.Layout.QMKKeymap(user.Locale)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	if err := writeExport(source); err != nil {
+		p.Println(err)
+	}
+}
+
+// QMKKeymap generates a keymap.c with a QMK layer for each layer and a QMK
+// combo for each combo. Keys whose shifted rune isn't what shift normally
+// gives are handled with key overrides.
+func (layout *Layout) QMKKeymap(locale Locale) (string, error) {
+	if layout.QMK == nil {
+		return "", fmt.Errorf("keyboard %s has no qmk section", layout.Name)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("// %s, generated by gokey\n", layout.Name))
+	sb.WriteString("#include QMK_KEYBOARD_H\n\n")
+	sb.WriteString("const uint16_t PROGMEM keymaps[][MATRIX_ROWS][MATRIX_COLS] = {\n")
+
+	var overrides []string
+	for layer := 0; layer <= len(layout.Layers); layer++ {
+		rows, err := layout.firmwareKeys(layout.QMK.Keys, layer, "KC_TRNS", func(keyInfo *KeyPhysicalInfo) (string, error) {
+			keycode, override, err := layout.qmkKey(keyInfo, locale)
+			if override != "" {
+				overrides = append(overrides, override)
+			}
+			return keycode, err
+		})
+		if err != nil {
+			return "", err
+		}
+
+		if layer > 0 {
+			sb.WriteString(fmt.Sprintf("    // %s\n", layout.Layers[layer-1].Name))
+		}
+		sb.WriteString(fmt.Sprintf("    [%d] = %s(\n", layer, layout.QMK.Layout))
+		sb.WriteString(formatKeyRows(rows, "        ", ","))
+		sb.WriteString("    ),\n")
+	}
+	sb.WriteString("};\n")
+
+	// Combos need COMBO_ENABLE = yes in rules.mk
+	var combos []string
+	for i := range layout.ComboKeys {
+		comboKey := &layout.ComboKeys[i]
+		if comboKey.key.UnshiftedIsFree {
+			continue
+		}
+		keycode, override, err := layout.qmkKey(comboKey, locale)
+		if err != nil {
+			return "", err
+		}
+		if override != "" {
+			overrides = append(overrides, override)
+		}
+		var keycodes []string
+		for _, position := range layout.comboPositions(comboKey) {
+			keyInfo, err := layout.keyAt(position, 0)
+			if err != nil {
+				return "", err
+			}
+			comboKeycode, _, err := layout.qmkKey(keyInfo, locale)
+			if err != nil {
+				return "", err
+			}
+			keycodes = append(keycodes, comboKeycode)
+		}
+		if len(combos) == 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(fmt.Sprintf("const uint16_t PROGMEM combo_%d[] = {%s, COMBO_END};\n", len(combos), strings.Join(keycodes, ", ")))
+		combos = append(combos, fmt.Sprintf("COMBO(combo_%d, %s)", len(combos), keycode))
+	}
+	if len(combos) > 0 {
+		sb.WriteString("\ncombo_t key_combos[] = {\n")
+		for _, combo := range combos {
+			sb.WriteString("    " + combo + ",\n")
+		}
+		sb.WriteString("};\n")
+	}
+
+	// Key overrides need KEY_OVERRIDE_ENABLE = yes in rules.mk
+	if len(overrides) > 0 {
+		sb.WriteString("\n")
+		names := make([]string, len(overrides))
+		for i, override := range overrides {
+			names[i] = fmt.Sprintf("&override_%d", i)
+			sb.WriteString(fmt.Sprintf("const key_override_t override_%d = %s;\n", i, override))
+		}
+		sb.WriteString("\nconst key_override_t *key_overrides[] = {\n")
+		sb.WriteString("    " + strings.Join(names, ", ") + "\n};\n")
+	}
+
+	return sb.String(), nil
+}
+
+// qmkKey returns the keycode for a key and, if shift doesn't give the key's
+// shifted rune, a key override producing it.
+func (layout *Layout) qmkKey(keyInfo *KeyPhysicalInfo, locale Locale) (string, string, error) {
+	key := keyInfo.key
+	if key.UnshiftedIsFree || key.UnshiftedRune == 0 {
+		return "KC_NO", "", nil
+	}
+	if layer, ok := isLayerRune(key.UnshiftedRune); ok {
+		switch layout.Layers[layer-1].Activation {
+		case Toggle:
+			return fmt.Sprintf("TG(%d)", layer), "", nil
+		case OneShot:
+			return fmt.Sprintf("OSL(%d)", layer), "", nil
+		default:
+			return fmt.Sprintf("MO(%d)", layer), "", nil
+		}
+	}
+	if modifier, ok := qmkModifiers[Modifier(key.UnshiftedRune)]; ok {
+		if layout.isLeftHand(keyInfo) {
+			return modifier[0], "", nil
+		}
+		return modifier[1], "", nil
+	}
+
+	keycode, shifted, err := qmkKeycode(key.UnshiftedRune, locale)
+	if err != nil {
+		return "", "", err
+	}
+	if key.ShiftedIsFree || key.ShiftedRune == 0 || key.ShiftedRune == shifted || key.ShiftedRune == key.UnshiftedRune {
+		return keycode, "", nil
+	}
+
+	shiftedKeycode, _, err := qmkKeycode(key.ShiftedRune, locale)
+	if err != nil {
+		return "", "", err
+	}
+	return keycode, fmt.Sprintf("ko_make_basic(MOD_MASK_SHIFT, %s, %s)", keycode, shiftedKeycode), nil
+}
+
+// qmkKeycode returns the keycode that types a rune, and the rune typed when
+// shift is held with it.
+func qmkKeycode(r rune, locale Locale) (string, rune, error) {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return "KC_" + string(unicode.ToUpper(r)), unicode.ToUpper(r), nil
+	case r >= 'A' && r <= 'Z':
+		return fmt.Sprintf("S(KC_%c)", r), r, nil
+	case r >= '1' && r <= '9', r == '0':
+		return "KC_" + string(r), locale.unshiftedToShifted[r], nil
+	}
+	if keycode, ok := qmkKeycodes[r]; ok {
+		shifted, ok := locale.unshiftedToShifted[r]
+		if !ok {
+			shifted = r
+		}
+		return keycode, shifted, nil
+	}
+	if unshifted, ok := locale.shiftedToUnshifted[r]; ok {
+		keycode, _, err := qmkKeycode(unshifted, locale)
+		if err != nil {
+			return "", 0, err
+		}
+		return "S(" + keycode + ")", r, nil
+	}
+	return "", 0, fmt.Errorf("no QMK keycode for %q", r)
+}
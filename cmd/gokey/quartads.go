@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"math"
 	"sort"
 	"strings"
 	"unicode"
@@ -15,8 +15,20 @@ const (
 	ShiftModifier Modifier = 0xE001 // Define the SHIFT modifier as a rune
 	CtrlModifier  Modifier = 0xE002 // Example: Define the CTRL modifier as another rune
 	AltModifier   Modifier = 0xE003 // Example: Define the ALT modifier as another rune
+	LayerModifier Modifier = 0xE100 // Layer keys are this plus the layer number
 )
 
+// layerRune returns the rune used for the key that reaches a layer.
+func layerRune(layer int) rune {
+	return rune(LayerModifier) + rune(layer)
+}
+
+// isLayerRune reports whether a rune is a layer key and which layer it reaches.
+func isLayerRune(r rune) (int, bool) {
+	layer := int(r - rune(LayerModifier))
+	return layer, layer > 0 && layer < 0x100
+}
+
 // Quartad struct represents a sequence of up to 4 runes (key presses)
 // along with their associated modifiers
 type Quartad struct {
@@ -47,12 +59,59 @@ func isValidRune(r rune, validRunes map[rune]int) bool {
 	return ok
 }
 
-func PrepareQuartadList(s string, user User) QuartadInfo {
+// PrepareQuartadList counts the runes in the corpus files, assigns them to
+// the user's layout and builds the quartads of the runes on the keyboard. The
+// files are read twice, once for each step, rather than held in memory.
+func PrepareQuartadList(referenceTextFiles []CorpusSource, user User) (QuartadInfo, error) {
+	layout := user.Layout
+
+	// Count the frequency of all the runes
+	foundRunes, blend, err := countRunes(referenceTextFiles, user)
+	if err != nil {
+		return QuartadInfo{}, err
+	}
+
+	// Map runes onto the keyboard in usage order (with essential first) so
+	// we can build quartads with what we know are on the keyboard
+	runesOnKeyboard, shiftedRunesOnKeyboard := layout.AssignRunesToKeys(foundRunes, user)
+
+	// Start from the keyboard the user knows, then move runes so the layout
+	// meets their hard constraints
+	if user.Reference != nil {
+		layout.ApplyReference(user.Reference)
+	}
+	if err := layout.ApplyConstraints(); err != nil {
+		return QuartadInfo{}, err
+	}
+
+	return buildQuartadInfo(blend, foundRunes, runesOnKeyboard, shiftedRunesOnKeyboard, user)
+}
+
+// PrepareLayoutQuartadList builds the quartads of the user's layout as it is,
+// without assigning anything to its free keys. They are built as
+// PrepareQuartadList builds them once runes are assigned, so a fully specified
+// layout scores the same when it is analyzed, compared or optimized.
+func PrepareLayoutQuartadList(referenceTextFiles []CorpusSource, user User) (QuartadInfo, error) {
+	foundRunes, blend, err := countRunes(referenceTextFiles, user)
+	if err != nil {
+		return QuartadInfo{}, err
+	}
+	return layoutQuartadInfo(blend, foundRunes, user.Layout, user)
+}
+
+// layoutQuartadInfo builds the quartads of a layout from the runes counted in
+// the corpus, so several layouts can be scored without counting them again.
+func layoutQuartadInfo(blend corpusBlend, foundRunes map[rune]int, layout Layout, user User) (QuartadInfo, error) {
+	runesOnKeyboard, shiftedRunesOnKeyboard := layout.RunesOnKeys(foundRunes)
+	return buildQuartadInfo(blend, foundRunes, runesOnKeyboard, shiftedRunesOnKeyboard, user)
+}
+
+// countRunes counts the frequency of every typeable rune in the corpus files,
+// making sure the runes the layout and user need are present even if unused.
+// It also returns how the files are blended, to build the quartads with.
+func countRunes(referenceTextFiles []CorpusSource, user User) (map[rune]int, corpusBlend, error) {
 	layout := user.Layout
 	foundRunes := make(map[rune]int)
-	quartads := make(QuartadList)
-	runes := []rune(s)
-	n := len(runes)
 
 	// Ensure essential runes are included
 	for _, r := range layout.EssentialRunes {
@@ -81,43 +140,103 @@ func PrepareQuartadList(s string, user User) QuartadInfo {
 		}
 	}
 
-	// Count the frequency of all the runes
-	for i := 0; i < n; i++ {
-		if isTypeableRune(runes[i]) {
-			if optDebug > 1 {
-				if _, ok := foundRunes[runes[i]]; !ok {
-					p.Printf("Found rune '%c'\n", RuneDisplayVersion(runes[i]))
-				}
+	// Shortcuts need their keys and modifiers on the keyboard
+	countShortcutRunes(foundRunes, user.Shortcuts)
+
+	// So do the runes the user has constrained
+	for _, c := range user.Layout.Constraints {
+		for _, r := range c.runes {
+			if _, ok := foundRunes[r]; !ok {
+				foundRunes[r] = 0
 			}
-			foundRunes[runes[i]]++
 		}
 	}
 
-	// Map runes onto the keyboard in usage order (with essential first) so
-	// we can build quartads with what we know are on the keyboard
-	runesOnKeyboard, shiftedRunesOnKeyboard := layout.AssignRunesToKeys(foundRunes, user)
-
-	for j := 0; j < len(runes); j++ {
-		if isValidRune(runes[j], runesOnKeyboard) {
-			// Start building a quartad only if the starting rune is valid
-			maxK := min(4, len(runes)-j)
-			for k := 1; k <= maxK; k++ {
-				// Check if all runes in the quartad are valid
-				allValid := true
-				for l := j; l < j+k; l++ {
-					if !isValidRune(runes[l], runesOnKeyboard) {
-						allValid = false
-						break
+	// Count the frequency of all the runes in each group of corpus files
+	groups, shares, err := corpusGroups(referenceTextFiles)
+	if err != nil {
+		return nil, corpusBlend{}, err
+	}
+	groupRunes := make([]map[rune]int, len(groups))
+	keystrokes := make([]int, len(groups))
+	caches := make([]*CorpusCache, len(groups))
+	for g, group := range groups {
+		counts := make(map[rune]int)
+		count := func(r rune, n int) {
+			if isTypeableRune(r) {
+				if optDebug > 1 {
+					if _, ok := counts[r]; !ok {
+						p.Printf("Found rune '%c'\n", RuneDisplayVersion(r))
 					}
 				}
-				if allValid {
-					quartad := MakeQuartad(string(runes[j:j+k]), shiftedRunesOnKeyboard)
-					quartads[quartad]++
-				} else {
-					break // No need to check longer quartads starting at j
-				}
+				counts[r] += n
+				keystrokes[g] += n
 			}
 		}
+
+		caches[g], err = readCorpusCache(group)
+		if err != nil {
+			return nil, corpusBlend{}, err
+		}
+		if caches[g] != nil {
+			caches[g].countRunes(count)
+		} else if err := scanCorpus(group, func(r rune) { count(r, 1) }, nil); err != nil {
+			return nil, corpusBlend{}, err
+		}
+		groupRunes[g] = counts
+	}
+
+	// Blend the groups by their shares
+	blend, err := newCorpusBlend(groups, shares, keystrokes)
+	if err != nil {
+		return nil, corpusBlend{}, err
+	}
+	blend.caches = caches
+	blended := make(map[rune]float64)
+	for g, counts := range groupRunes {
+		for r, count := range counts {
+			blended[r] += float64(count) * blend.scales[g]
+		}
+	}
+	for r, count := range blended {
+		foundRunes[r] += int(math.Round(count))
+	}
+
+	return foundRunes, blend, nil
+}
+
+// buildQuartadInfo builds the quartads made up only of runes on the keyboard,
+// blending the counts of each group of corpus files like their runes. Runes
+// that aren't on the keyboard only appear on their own.
+func buildQuartadInfo(blend corpusBlend, foundRunes map[rune]int, runesOnKeyboard map[rune]int, shiftedRunesOnKeyboard map[rune]int, user User) (QuartadInfo, error) {
+	quartads := make(QuartadList)
+
+	blended := make(map[Quartad]float64)
+	for g, group := range blend.groups {
+		counter := quartadCounter{quartads: make(QuartadList), runesOnKeyboard: runesOnKeyboard, shiftedRunes: shiftedRunesOnKeyboard}
+		if blend.caches[g] != nil {
+			blend.caches[g].countQuartads(&counter)
+		} else if err := scanCorpus(group, counter.add, counter.split); err != nil {
+			return QuartadInfo{}, err
+		}
+		for quartad, count := range counter.quartads {
+			blended[quartad] += float64(count) * blend.scales[g]
+		}
+	}
+	for quartad, count := range blended {
+		if rounded := int(math.Round(count)); rounded > 0 {
+			quartads[quartad] = rounded
+		}
+	}
+
+	addShortcutQuartads(quartads, user.Shortcuts, runesOnKeyboard)
+
+	// Runes that aren't on the keyboard are still typed, so keep a count of
+	// them to show they are missing
+	for r, count := range foundRunes {
+		if _, ok := runesOnKeyboard[r]; !ok && count > 0 {
+			quartads[MakeQuartad(string(r), shiftedRunesOnKeyboard)] += count
+		}
 	}
 
 	// Count all the runes being used on the keyboard as algorithms will need this later. Also count how many keypresses we have
@@ -133,27 +252,15 @@ func PrepareQuartadList(s string, user User) QuartadInfo {
 	// Add quartad for backspace usage
 	quartads[MakeQuartad("\b", shiftedRunesOnKeyboard)] = int(float64(keypresses) * user.BackspaceUsage / 100.0)
 
-	return QuartadInfo{quartads, runesOnKeyboardResult}
+	return QuartadInfo{quartads, runesOnKeyboardResult}, nil
 }
 
-func GetQuartadList(referenceTextFiles []string, user User) (QuartadInfo, error) {
-	// Read all the requested corpus files and concatenate them
-	sb := strings.Builder{}
-
-	for _, referenceTextFile := range referenceTextFiles {
-		// Open the corpus reference file and read the entire file content
-		content, err := os.ReadFile(referenceTextFile)
-		if err != nil {
-			return QuartadInfo{}, fmt.Errorf("error reading file: %w", err)
-		}
-
-		// Convert []byte to string and return
-		text := string(content)
-		sb.WriteString(text)
-	}
-
+func GetQuartadList(referenceTextFiles []CorpusSource, user User) (QuartadInfo, error) {
 	// Process the text
-	quartadInfo := PrepareQuartadList(sb.String(), user)
+	quartadInfo, err := PrepareQuartadList(referenceTextFiles, user)
+	if err != nil {
+		return QuartadInfo{}, err
+	}
 
 	// Print debug information
 	if optDebug > 1 {
@@ -170,6 +277,12 @@ func GetQuartadList(referenceTextFiles []string, user User) (QuartadInfo, error)
 	return quartadInfo, nil
 }
 
+// GetLayoutQuartadList reads the corpus files and builds the quartads of the
+// user's layout as it is, see PrepareLayoutQuartadList.
+func GetLayoutQuartadList(referenceTextFiles []CorpusSource, user User) (QuartadInfo, error) {
+	return PrepareLayoutQuartadList(referenceTextFiles, user)
+}
+
 // Equals checks if two Quartads are equal, considering the length of the quartad.
 // It compares both the runes and modifiers for each valid element.
 func (q Quartad) Equals(other Quartad) bool {
@@ -289,8 +402,14 @@ func (q Quartad) GetModifier(i int) Modifier {
 }
 
 func MakeQuartad(s string, shiftedRunes map[rune]int) Quartad {
+	return quartadOf([]rune(s), shiftedRunes)
+}
+
+// quartadOf makes a quartad of up to four runes, shifting those in
+// shiftedRunes.
+func quartadOf(runes []rune, shiftedRunes map[rune]int) Quartad {
 	var q Quartad
-	for _, r := range s {
+	for _, r := range runes {
 		modifier := NoModifier
 		if _, isShifted := shiftedRunes[r]; isShifted {
 			modifier = ShiftModifier
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"unicode"
+)
+
+// Save writes the layout as a keyboard file in the format read by ReadLayout.
+// Every key that has runes assigned is written as fixed, so the file can be
+// scored as it is or used as the starting point for further tuning.
+func (layout *Layout) Save(filename string) error {
+	data, err := layout.MarshalKeyboard()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		return fmt.Errorf("error writing layout: %w", err)
+	}
+	return nil
+}
+
+// MarshalKeyboard converts the layout back into keyboard file JSON.
+func (layout *Layout) MarshalKeyboard() ([]byte, error) {
+	saved := layout.Duplicate()
+	for _, side := range []*Side{&saved.Left, &saved.Right} {
+		side.RawRows = saved.rawRows(side.Rows)
+		side.RawLayers = nil
+		for i, layer := range saved.Layers {
+			if len(side.LayerRows[i]) == 0 {
+				continue
+			}
+			if side.RawLayers == nil {
+				side.RawLayers = make(map[string][][]string)
+			}
+			side.RawLayers[layer.Name] = saved.rawRows(side.LayerRows[i])
+		}
+	}
+	for i := range saved.ComboKeys {
+		keyStr := saved.keyString(&saved.ComboKeys[i])
+		saved.Combos[i].Key = keyStr[:len(keyStr)-1]
+	}
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return compactJSON(data), nil
+}
+
+func (layout *Layout) rawRows(rows [][]KeyPhysicalInfo) [][]string {
+	rawRows := make([][]string, len(rows))
+	for r, row := range rows {
+		rawRows[r] = make([]string, len(row))
+		for c := range row {
+			rawRows[r][c] = layout.keyString(&row[c])
+		}
+	}
+	return rawRows
+}
+
+// keyString is the inverse of parseKeyString. Keys with nothing assigned are
+// left free to place.
+func (layout *Layout) keyString(kpi *KeyPhysicalInfo) string {
+	key := kpi.key
+	content := "*"
+	if layer, ok := isLayerRune(key.UnshiftedRune); ok && !key.UnshiftedIsFree {
+		content = "@" + layout.Layers[layer-1].Name
+	} else if !key.UnshiftedIsFree {
+		content = runeToKeyString(key.UnshiftedRune)
+
+		// Keyboards that support overrides can't derive the shifted rune from
+		// the locale, so it is written after the unshifted one
+		if layout.SupportsOverrides && !unicode.IsLetter(key.UnshiftedRune) &&
+			!key.ShiftedIsFree && key.ShiftedRune != key.UnshiftedRune {
+			content += runeToKeyString(key.ShiftedRune)
+		}
+	}
+	return content + string(fingerChar(kpi.associatedFinger))
+}
+
+func runeToKeyString(r rune) string {
+	switch r {
+	case rune(ShiftModifier):
+		return "^"
+	case rune(CtrlModifier):
+		return "ctrl"
+	case rune(AltModifier):
+		return "alt"
+	case '*', '^':
+		// These mean a free key and Shift when not escaped
+		return `\` + string(r)
+	default:
+		return string(unicode.ToUpper(r))
+	}
+}
+
+func fingerChar(finger Finger) byte {
+	switch finger {
+	case Thumb:
+		return 'T'
+	case Index:
+		return 'I'
+	case Middle:
+		return 'M'
+	case Ring:
+		return 'R'
+	case Pinkie:
+		return 'P'
+	default:
+		return '?'
+	}
+}
+
+var (
+	jsonStringArray = regexp.MustCompile(`\[\s*("(?:[^"\\]|\\.)*"(?:,\s*"(?:[^"\\]|\\.)*")*)\s*\]`)
+	jsonNumberArray = regexp.MustCompile(`\[\s*(-?[0-9.e+-]+(?:,\s*-?[0-9.e+-]+)*)\s*\]`)
+	jsonSmallObject = regexp.MustCompile(`\{\s*("[a-z_]+": -?[0-9.]+(?:,\s*"[a-z_]+": -?[0-9.]+)*)\s*\}`)
+	jsonLineBreak   = regexp.MustCompile(`\n\s*`)
+)
+
+// compactJSON keeps indented JSON readable by putting arrays of strings or
+// numbers and small numeric objects, like rows of keys, key positions and home
+// positions, on one line.
+// Line breaks never appear inside JSON strings so they can be removed safely.
+func compactJSON(data []byte) []byte {
+	collapse := func(match []byte) []byte {
+		match = bytes.ReplaceAll(match, []byte(",\n"), []byte(", \n"))
+		return jsonLineBreak.ReplaceAll(match, nil)
+	}
+	data = jsonStringArray.ReplaceAllFunc(data, collapse)
+	data = jsonNumberArray.ReplaceAllFunc(data, collapse)
+	return jsonSmallObject.ReplaceAllFunc(data, collapse)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/text/message"
+)
+
+const testCorpus = `Alice was beginning to get very tired of sitting by her sister on the bank,
+and of having nothing to do: once or twice she had peeped into the book her
+sister was reading, but it had no pictures or conversations in it, "and what is
+the use of a book," thought Alice "without pictures or conversations?"
+func main() { fmt.Println("Hello, World!") } // x := a[0] * b[1] ^ 0x2A; #42 @home
+`
+
+// readTestUser reads mark's profile from the root of the repository, with a
+// small corpus and the keyboard given, which may be a path to a keyboard
+// file.
+func readTestUser(t *testing.T, keyboard string) User {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(wd) == "gokey" {
+		if err := os.Chdir("../.."); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Chdir(wd) })
+	}
+	p = message.NewPrinter(message.MatchLanguage("en"))
+	r = rand.New(rand.NewSource(1))
+
+	corpus := filepath.Join(t.TempDir(), "corpus.txt")
+	if err := os.WriteFile(corpus, []byte(testCorpus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	optLayout = keyboard
+	defer func() { optLayout = "" }()
+	user, err := ReadUser("users/mark.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Corpus = []CorpusSource{{Path: corpus}}
+	return user
+}
+
+func scoreTestUser(t *testing.T, user User) (float64, Layout) {
+	t.Helper()
+	quartadInfo, err := PrepareQuartadList(user.Corpus, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := InitPenaltyRules(user)
+	total, _ := CalculatePenalty(quartadInfo.Quartads, user.Layout, user.Layout.mapRunesToPhysicalKeyInfo(), &rules)
+	return total, user.Layout
+}
+
+func TestSavedLayoutScoresTheSameWhenReloaded(t *testing.T) {
+	// A copy of a keyboard that supports overrides, whose shifted runes are
+	// placed separately
+	data, err := os.ReadFile("../../keyboards/zsa-voyager.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overrides := filepath.Join(t.TempDir(), "overrides.json")
+	data = bytes.Replace(data, []byte(`"supports_overrides": false`), []byte(`"supports_overrides": true`), 1)
+	if err := os.WriteFile(overrides, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyboard := range []string{"zsa-voyager", "crkbd-sym", overrides} {
+		user := readTestUser(t, keyboard)
+		want, layout := scoreTestUser(t, user)
+
+		filename := filepath.Join(t.TempDir(), "saved.json")
+		if err := layout.Save(filename); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := scoreTestUser(t, readTestUser(t, filename))
+		if math.Abs(got-want) > 1e-6*want {
+			t.Errorf("%s: saved layout scores %f, want %f", keyboard, got, want)
+		}
+	}
+}
+
+func TestSavedKeysReadBackAsTheSameRunes(t *testing.T) {
+	user := readTestUser(t, "zsa-voyager")
+	layout := user.Layout
+	layout.SupportsOverrides = true
+	essential := make(map[rune]bool)
+	for _, pair := range [][2]rune{{'*', '^'}, {'^', '*'}, {'8', '*'}, {'\\', '|'}, {'a', 'A'}} {
+		keyInfo := layout.Left.Rows[1][1]
+		keyInfo.key = &Key{UnshiftedRune: pair[0], ShiftedRune: pair[1]}
+		keyStr := layout.keyString(&keyInfo)
+
+		parsed, err := layout.parseKeyString(&layout.Left, 1, 1, keyStr, &essential, true, user.Locale)
+		if err != nil {
+			t.Fatalf("%q: %v", keyStr, err)
+		}
+		if parsed.key.UnshiftedRune != pair[0] || parsed.key.ShiftedRune != pair[1] || parsed.swappable {
+			t.Errorf("%q read back as %q and %q, want %q and %q", keyStr, parsed.key.UnshiftedRune, parsed.key.ShiftedRune, pair[0], pair[1])
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Chord is a key typed while holding a modifier, like ctrl+c.
+type Chord struct {
+	Rune     rune
+	Modifier Modifier
+}
+
+// Shortcut is a sequence of up to four chords and the number of times it is
+// used.
+type Shortcut struct {
+	Chords []Chord
+	Count  int
+}
+
+var chordKeyNames = map[string]rune{
+	"space":     ' ',
+	"enter":     '\n',
+	"return":    '\n',
+	"tab":       '\t',
+	"backspace": '\b',
+}
+
+var chordModifiers = map[string]Modifier{
+	"shift": ShiftModifier,
+	"ctrl":  CtrlModifier,
+	"alt":   AltModifier,
+}
+
+// ReadShortcuts reads shortcut files. Each line has one or more chords, like
+// "ctrl+c" or "ctrl+k ctrl+c", followed by the number of times it is used.
+// Blank lines and lines starting with # are ignored.
+func ReadShortcuts(filenames []string) ([]Shortcut, error) {
+	var shortcuts []Shortcut
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file: %w", err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			shortcut, err := parseShortcut(fields)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+			}
+			shortcuts = append(shortcuts, shortcut)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading file: %w", err)
+		}
+	}
+	return shortcuts, nil
+}
+
+func parseShortcut(fields []string) (Shortcut, error) {
+	if len(fields) < 2 || len(fields) > 5 {
+		return Shortcut{}, fmt.Errorf("expected one to four chords and a count")
+	}
+	count, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || count < 0 {
+		return Shortcut{}, fmt.Errorf("invalid count %q", fields[len(fields)-1])
+	}
+
+	shortcut := Shortcut{Count: count}
+	for _, field := range fields[:len(fields)-1] {
+		chord, err := parseChord(field)
+		if err != nil {
+			return Shortcut{}, err
+		}
+		shortcut.Chords = append(shortcut.Chords, chord)
+	}
+	return shortcut, nil
+}
+
+// parseChord parses a chord like "ctrl+c", "alt+enter" or "ctrl++". Only one
+// modifier can be held.
+func parseChord(s string) (Chord, error) {
+	modifierName, keyName := "", s
+	if i := strings.LastIndex(s[:len(s)-1], "+"); i >= 0 {
+		modifierName, keyName = strings.ToLower(s[:i]), s[i+1:]
+	}
+
+	chord := Chord{Modifier: NoModifier}
+	if modifierName != "" {
+		modifier, ok := chordModifiers[modifierName]
+		if !ok {
+			return Chord{}, fmt.Errorf("unknown modifier in %q, only one of shift, ctrl or alt can be used", s)
+		}
+		chord.Modifier = modifier
+	}
+
+	if r, ok := chordKeyNames[strings.ToLower(keyName)]; ok {
+		chord.Rune = r
+	} else if utf8.RuneCountInString(keyName) == 1 {
+		r, _ := utf8.DecodeRuneInString(keyName)
+		chord.Rune = unicode.ToLower(r)
+	} else {
+		return Chord{}, fmt.Errorf("unknown key in %q", s)
+	}
+	return chord, nil
+}
+
+// addShortcutQuartads adds the quartads of every run of up to four chords in
+// the shortcuts, like buildQuartadInfo does for runes. Chords are only used
+// if their rune and modifier are on the keyboard.
+func addShortcutQuartads(quartads QuartadList, shortcuts []Shortcut, runesOnKeyboard map[rune]int) {
+	onKeyboard := func(chord Chord) bool {
+		return isValidRune(chord.Rune, runesOnKeyboard) &&
+			(chord.Modifier == NoModifier || isValidRune(rune(chord.Modifier), runesOnKeyboard))
+	}
+
+	for _, shortcut := range shortcuts {
+		for j := range shortcut.Chords {
+			for k := j; k < min(j+4, len(shortcut.Chords)) && onKeyboard(shortcut.Chords[k]); k++ {
+				var quartad Quartad
+				for _, chord := range shortcut.Chords[j : k+1] {
+					addRuneToQuartad(&quartad, chord.Rune, chord.Modifier)
+				}
+				quartads[quartad] += shortcut.Count
+			}
+		}
+	}
+}
+
+// countShortcutRunes adds the runes and modifiers of the shortcuts to the
+// rune counts so they are placed on the keyboard.
+func countShortcutRunes(foundRunes map[rune]int, shortcuts []Shortcut) {
+	for _, shortcut := range shortcuts {
+		for _, chord := range shortcut.Chords {
+			foundRunes[chord.Rune] += shortcut.Count
+			if chord.Modifier != NoModifier {
+				foundRunes[rune(chord.Modifier)] += shortcut.Count
+			}
+		}
+	}
+}
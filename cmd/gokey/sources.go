@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// binaryCheckSize is how much of a file is checked for NUL bytes to decide
+// it's binary, as git does.
+const binaryCheckSize = 8000
+
+// corpusFile is a file read for the corpus and the preprocessors of the entry
+// it came from. Walked is set for files found in a directory or by a pattern,
+// which are each read on their own.
+type corpusFile struct {
+	Path       string
+	Preprocess []string
+	Walked     bool
+}
+
+// corpusStreams returns the files of a group of corpus sources split into
+// streams, which are read as though the files in each were joined together.
+// Files named directly in a row make up one stream and each file found in a
+// directory or by a pattern is a stream of its own, so quartads never span
+// them.
+func corpusStreams(group []CorpusSource) ([][]corpusFile, error) {
+	var streams [][]corpusFile
+	joined := false
+	for _, source := range group {
+		if !source.walked() {
+			if !joined {
+				streams = append(streams, nil)
+				joined = true
+			}
+			streams[len(streams)-1] = append(streams[len(streams)-1], corpusFile{Path: source.Path, Preprocess: source.Preprocess})
+			continue
+		}
+
+		files, err := source.walk()
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("corpus %s has no files to read", source.Path)
+		}
+		for _, file := range files {
+			streams = append(streams, []corpusFile{{Path: file, Preprocess: source.Preprocess, Walked: true}})
+		}
+		joined = false
+	}
+	return streams, nil
+}
+
+// corpusFiles returns every file read for the corpus sources.
+func corpusFiles(sources []CorpusSource) ([]string, error) {
+	streams, err := corpusStreams(sources)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, stream := range streams {
+		for _, file := range stream {
+			files = append(files, file.Path)
+		}
+	}
+	return files, nil
+}
+
+// walked reports whether the source is a directory or a pattern rather than
+// a file.
+func (source CorpusSource) walked() bool {
+	if isGlob(source.Path) {
+		return true
+	}
+	info, err := os.Stat(source.Path)
+	return err == nil && info.IsDir()
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// walk finds the text files in a directory or matching a pattern, in lexical
+// order. Hidden files and directories, those ignored by a .gitignore in the
+// directories walked, binary files and files whose extensions aren't included
+// or are excluded are skipped.
+func (source CorpusSource) walk() ([]string, error) {
+	root, pattern := filepath.ToSlash(filepath.Clean(source.Path)), ""
+	if isGlob(source.Path) {
+		// Walk from the directory above the first part with a wildcard
+		pattern = root
+		segments := strings.Split(root, "/")
+		base := 0
+		for base < len(segments) && !isGlob(segments[base]) {
+			base++
+		}
+		root = strings.Join(segments[:base], "/")
+		if root == "" {
+			root = "."
+			if strings.HasPrefix(pattern, "/") {
+				root = "/"
+			}
+		}
+	}
+
+	var files []string
+	ignores := make(map[string][]ignoreRule)
+	err := filepath.WalkDir(filepath.FromSlash(root), func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error reading corpus %s: %w", source.Path, err)
+		}
+		slashed := filepath.ToSlash(name)
+		hidden := slashed != root && strings.HasPrefix(entry.Name(), ".")
+		if entry.IsDir() {
+			if hidden || (slashed != root && isIgnored(ignores, root, slashed, true)) {
+				return filepath.SkipDir
+			}
+			rules, err := readGitignore(slashed)
+			if err != nil {
+				return err
+			}
+			ignores[slashed] = rules
+			return nil
+		}
+		if hidden || !isRegularFile(name, entry) || isIgnored(ignores, root, slashed, false) {
+			return nil
+		}
+		if pattern != "" && !matchPath(pattern, slashed) {
+			return nil
+		}
+		if !source.includes(slashed) {
+			return nil
+		}
+		binary, err := isBinaryFile(name)
+		if err != nil {
+			return err
+		}
+		if !binary {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// isRegularFile reports whether an entry is a file or a link to one.
+func isRegularFile(name string, entry fs.DirEntry) bool {
+	if entry.Type()&fs.ModeSymlink != 0 {
+		info, err := os.Stat(name)
+		return err == nil && info.Mode().IsRegular()
+	}
+	return entry.Type().IsRegular()
+}
+
+// includes reports whether the extension filters let a file through.
+func (source CorpusSource) includes(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, excluded := range source.Exclude {
+		if ext == normalizeExtension(excluded) {
+			return false
+		}
+	}
+	if len(source.Include) == 0 {
+		return true
+	}
+	for _, included := range source.Include {
+		if ext == normalizeExtension(included) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+func isBinaryFile(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, fmt.Errorf("error reading file: %w", err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, binaryCheckSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("error reading file: %w", err)
+	}
+	return bytes.IndexByte(buf[:n], 0) >= 0, nil
+}
+
+// matchPath matches a slash separated path against a pattern where each part
+// is matched as in path.Match and ** matches any number of directories.
+func matchPath(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+// ignoreRule is a pattern from a .gitignore file.
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+func readGitignore(dir string) ([]ignoreRule, error) {
+	f, err := os.Open(filepath.Join(filepath.FromSlash(dir), ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	defer f.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		// Patterns without a slash match at any depth and the rest match from
+		// the directory of the .gitignore
+		if strings.Contains(line, "/") {
+			rule.pattern = strings.TrimPrefix(line, "/")
+		} else {
+			rule.pattern = "**/" + line
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading file: %w", err)
+	}
+	return rules, nil
+}
+
+// isIgnored checks a path against the .gitignore files of the directories
+// above it, up to the root of the walk. Deeper files take priority, and later
+// rules over earlier ones.
+func isIgnored(ignores map[string][]ignoreRule, root string, name string, dir bool) bool {
+	var dirs []string
+	for d := path.Dir(name); ; d = path.Dir(d) {
+		dirs = append(dirs, d)
+		if d == root || d == "." || d == "/" {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel := strings.TrimPrefix(name, dirs[i]+"/")
+		if dirs[i] == "." {
+			rel = name
+		}
+		for _, rule := range ignores[dirs[i]] {
+			if rule.dirOnly && !dir {
+				continue
+			}
+			if matchPath(rule.pattern, rel) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
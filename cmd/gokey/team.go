@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	SumObjective    = "sum"    // Weighted sum of the users' normalized penalties
+	MinMaxObjective = "minmax" // The worst of the users' weighted normalized penalties
+)
+
+var (
+	optObjective string
+	optWeights   []float64
+	teamCmd      = &cobra.Command{
+		Use:   "team [username...]",
+		Short: "Optimize one layout shared by several users.",
+		Long: `Optimize a single layout for several users, each scored with their own
+corpus, finger costs and penalties. Everyone uses the first user's keyboard
+unless --layout is given. Each user's penalty is normalized by their penalty
+on the starting layout so that no one dominates because of the size of their
+corpus. Team runs aren't checkpointed.`,
+		Args: cobra.MinimumNArgs(2),
+		Run:  team,
+	}
+)
+
+func init() {
+	teamCmd.Flags().StringVar(&optObjective, "objective", SumObjective, "How to combine the users' penalties (sum or minmax)")
+	teamCmd.Flags().Float64SliceVar(&optWeights, "weights", nil, "Weight of each user, in the order they are given (defaults to 1 each)")
+	teamCmd.Flags().IntVarP(&optIterations, "iterations", "i", 10000, "Number of iterations")
+	teamCmd.Flags().IntVarP(&optSwaps, "swaps", "s", 3, "Number key swaps per iteration")
+	teamCmd.Flags().StringVarP(&optLayout, "layout", "l", "", "Override layout name")
+	teamCmd.Flags().IntVarP(&optWorkers, "workers", "w", 1, "Number of annealing chains to run in parallel (0 for one per CPU)")
+	teamCmd.Flags().Int64Var(&optSeed, "seed", 0, "Random seed for a reproducible run (defaults to the current time)")
+	teamCmd.Flags().StringVar(&optRunsDir, "runs-dir", "runs", "Directory to write run manifests to")
+	teamCmd.Flags().StringVar(&optSave, "save", "", "Also save the best layout as keyboards/<name>.json")
+	rootCmd.AddCommand(teamCmd)
+}
+
+// TeamMember is one of the users sharing a layout.
+type TeamMember struct {
+	Username    string
+	User        User
+	QuartadInfo QuartadInfo
+	Weight      float64 // Scaled so the weights average 1
+	Baseline    float64 // Penalty of the starting layout
+}
+
+// Team is several users optimizing one layout. Each member's penalty is
+// divided by their baseline and multiplied by Scale, the average baseline, so
+// the team's penalty is on the same scale as a single user's.
+type Team struct {
+	Members   []TeamMember
+	Objective string
+	Scale     float64
+}
+
+func team(cmd *cobra.Command, args []string) {
+	seed := optSeed
+	if !cmd.Flags().Changed("seed") {
+		seed = time.Now().UnixNano()
+	}
+	r = rand.New(rand.NewSource(seed))
+
+	if optObjective != SumObjective && optObjective != MinMaxObjective {
+		p.Printf("unknown objective %q\n", optObjective)
+		return
+	}
+	if len(optWeights) > 0 && len(optWeights) != len(args) {
+		p.Printf("%d weights were given for %d users\n", len(optWeights), len(args))
+		return
+	}
+	if err := checkSaveName(optSave); err != nil {
+		p.Println(err)
+		return
+	}
+
+	t, layout, err := ReadTeam(args, optWeights, optObjective)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+
+	// Record how this run was started, with a manifest for each member
+	name := strings.Join(args, "+")
+	manifest, err := NewRunManifest(cmd, name, "users/"+args[0]+".json", t.Members[0].User, seed)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	for _, member := range t.Members[1:] {
+		memberManifest, err := NewRunManifest(cmd, member.Username, "users/"+member.Username+".json", member.User, seed)
+		if err != nil {
+			p.Println(err)
+			return
+		}
+		manifest.Members = append(manifest.Members, memberManifest)
+	}
+	runDir, err := makeRunDir(optRunsDir, "team", manifest.Started)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	if err := manifest.Write(runDir); err != nil {
+		p.Println(err)
+		return
+	}
+	p.Printf("Run %s (seed %s)\n", runDir, fmt.Sprint(seed))
+	p.Println(layout.StringWithCosts())
+
+	workers := optWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	watchForInterrupt()
+
+	bestLayout := Optimize(t.Members[0].QuartadInfo, layout, t.User(), &t, nil, optIterations, optSwaps, workers, nil)
+	saveBestLayout(bestLayout, runDir, optSave)
+}
+
+// ReadTeam reads the users and places the runes they all need on the first
+// user's layout, which is returned with the team. Runes are placed by how
+// often each user types them as a share of everything they type, and every
+// user's hard constraints are met.
+func ReadTeam(usernames []string, weights []float64, objective string) (Team, Layout, error) {
+	t := Team{Objective: objective}
+	counts := make([]map[rune]int, len(usernames))
+	blends := make([]corpusBlend, len(usernames))
+	combined := make(map[rune]int)
+	var constraints []Constraint
+	for i, username := range usernames {
+		user, err := ReadUser("users/" + username + ".json")
+		if err != nil {
+			return Team{}, Layout{}, fmt.Errorf("%s: %w", username, err)
+		}
+		if i == 0 && optLayout == "" {
+			// Everyone shares the first user's keyboard
+			optLayout = user.Keyboard
+		}
+
+		counts[i], blends[i], err = countRunes(user.Corpus, user)
+		if err != nil {
+			return Team{}, Layout{}, fmt.Errorf("%s: %w", username, err)
+		}
+		total := 0
+		for _, count := range counts[i] {
+			total += count
+		}
+		for r, count := range counts[i] {
+			combined[r] += int(float64(count) / float64(max(total, 1)) * 1e9)
+		}
+		constraints = append(constraints, user.Layout.Constraints...)
+
+		weight := 1.0
+		if len(weights) > 0 {
+			weight = weights[i]
+		}
+		if weight <= 0 {
+			return Team{}, Layout{}, fmt.Errorf("%s: weights must be positive", username)
+		}
+		t.Members = append(t.Members, TeamMember{Username: username, User: user, Weight: weight})
+	}
+
+	// Scale the weights so they average 1
+	weightSum := 0.0
+	for _, member := range t.Members {
+		weightSum += member.Weight
+	}
+	for i := range t.Members {
+		t.Members[i].Weight *= float64(len(t.Members)) / weightSum
+	}
+
+	// Place the runes on the first user's layout
+	layout := t.Members[0].User.Layout.Duplicate()
+	layout.Constraints = constraints
+	runesOnKeyboard, shiftedRunesOnKeyboard := layout.AssignRunesToKeys(combined, t.Members[0].User)
+
+	// Start from the keyboards the members know, with the first member's
+	// reference applied last so it wins, then meet everyone's hard constraints
+	for i := len(t.Members) - 1; i >= 0; i-- {
+		if reference := t.Members[i].User.Reference; reference != nil {
+			layout.ApplyReference(reference)
+		}
+	}
+	if err := layout.ApplyConstraints(); err != nil {
+		return Team{}, Layout{}, err
+	}
+
+	// Each member types the same runes with their own quartads, and their
+	// baseline is their penalty on the starting layout
+	for i := range t.Members {
+		member := &t.Members[i]
+		quartadInfo, err := buildQuartadInfo(blends[i], counts[i], runesOnKeyboard, shiftedRunesOnKeyboard, member.User)
+		if err != nil {
+			return Team{}, Layout{}, fmt.Errorf("%s: %w", member.Username, err)
+		}
+		member.QuartadInfo = quartadInfo
+		memberLayout, err := member.layoutLike(&layout)
+		if err != nil {
+			return Team{}, Layout{}, fmt.Errorf("%s: %w", member.Username, err)
+		}
+		penaltyRules := InitPenaltyRules(member.User)
+		member.Baseline, _ = CalculatePenalty(member.QuartadInfo.Quartads, memberLayout, memberLayout.mapRunesToPhysicalKeyInfo(), &penaltyRules)
+		if member.Baseline <= 0 {
+			return Team{}, Layout{}, fmt.Errorf("%s: the starting layout has no penalty to normalize by", member.Username)
+		}
+		t.Scale += member.Baseline / float64(len(t.Members))
+	}
+
+	return t, layout, nil
+}
+
+// layoutLike returns the member's layout with the runes placed as they are on
+// the team's layout.
+func (member *TeamMember) layoutLike(layout *Layout) (Layout, error) {
+	memberLayout := member.User.Layout.Duplicate()
+	if err := memberLayout.setKeyContents(layout.keyContents()); err != nil {
+		return Layout{}, err
+	}
+	return memberLayout, nil
+}
+
+// User returns the first member with the team's starting penalty watermark,
+// for the parts of the optimizer that only know about one user.
+func (t *Team) User() User {
+	user := t.Members[0].User
+	user.StartingPenaltyWatermark = 0
+	for _, member := range t.Members {
+		user.StartingPenaltyWatermark += member.User.StartingPenaltyWatermark / float64(len(t.Members))
+	}
+	return user
+}
+
+// objective combines the members' penalties into the team's penalty.
+func (t *Team) objective(penalties []float64) float64 {
+	total := 0.0
+	for i, member := range t.Members {
+		normalized := member.Weight * penalties[i] / member.Baseline * t.Scale
+		if t.Objective == MinMaxObjective {
+			total = math.Max(total, normalized)
+		} else {
+			total += normalized / float64(len(t.Members))
+		}
+	}
+	return total
+}
+
+// TeamEvaluator scores a layout for every member of a team. Each member has
+// their own PenaltyEvaluator on their own copy of the layout, and every swap
+// is made on all of the copies.
+type TeamEvaluator struct {
+	team       *Team
+	evaluators []*PenaltyEvaluator
+	penalties  [][]KeyPenalty
+	scores     []float64
+}
+
+// NewEvaluator returns an evaluator for the team which takes ownership of the
+// layout, as NewPenaltyEvaluator does. The layout holds the first member's
+// costs.
+func (t *Team) NewEvaluator(layout *Layout) *TeamEvaluator {
+	e := &TeamEvaluator{
+		team:       t,
+		evaluators: make([]*PenaltyEvaluator, len(t.Members)),
+		penalties:  make([][]KeyPenalty, len(t.Members)),
+		scores:     make([]float64, len(t.Members)),
+	}
+	for i := range t.Members {
+		member := &t.Members[i]
+		memberLayout := layout
+		if i > 0 {
+			// Same keyboard, so the copies can't differ in their keys
+			copied, err := member.layoutLike(layout)
+			if err != nil {
+				panic(fmt.Errorf("%s: %w", member.Username, err))
+			}
+			memberLayout = &copied
+		}
+		e.penalties[i] = InitPenaltyRules(member.User)
+		e.evaluators[i] = NewPenaltyEvaluator(member.QuartadInfo.Quartads, memberLayout, &e.penalties[i])
+	}
+	return e
+}
+
+// Layout returns the layout being evaluated, with the first member's costs.
+func (e *TeamEvaluator) Layout() *Layout {
+	return e.evaluators[0].Layout()
+}
+
+// Shuffle makes the same random swaps on every member's layout. Swaps that
+// would break a hard constraint of any member are skipped.
+func (e *TeamEvaluator) Shuffle(rng *rand.Rand, numSwaps int) {
+	first := e.evaluators[0]
+	if len(first.swappable) < 2 {
+		return
+	}
+	constrained := first.layout.hasHardConstraints()
+	for i := 0; i < numSwaps; i++ {
+		a, b := randomPair(rng, len(first.swappable))
+		if constrained && !first.meetsHardConstraints(first.swappable[a], first.swappable[b]) {
+			continue
+		}
+		for _, evaluator := range e.evaluators {
+			evaluator.Swap(evaluator.swappable[a], evaluator.swappable[b])
+		}
+	}
+}
+
+// Score returns the team's penalty for the layout.
+func (e *TeamEvaluator) Score() float64 {
+	for i, evaluator := range e.evaluators {
+		e.scores[i] = evaluator.Score()
+	}
+	return e.team.objective(e.scores)
+}
+
+// Commit accepts the swaps made since the last Commit or Revert.
+func (e *TeamEvaluator) Commit() {
+	for _, evaluator := range e.evaluators {
+		evaluator.Commit()
+	}
+}
+
+// Revert undoes the swaps made since the last Commit or Revert.
+func (e *TeamEvaluator) Revert() {
+	for _, evaluator := range e.evaluators {
+		evaluator.Revert()
+	}
+}
+
+// Results returns the team's penalty with a result for each member holding
+// their normalized penalty. Each member's watermark is the team's scale, so
+// it is shown as a percentage of their penalty on the starting layout.
+func (e *TeamEvaluator) Results() (float64, []KeyPenaltyResult) {
+	penalties := make([]float64, len(e.evaluators))
+	results := make([]KeyPenaltyResult, len(e.evaluators))
+	for i, evaluator := range e.evaluators {
+		member := &e.team.Members[i]
+		penalties[i], _ = evaluator.Results()
+		results[i] = KeyPenaltyResult{
+			Name:             member.Username,
+			Total:            penalties[i] / member.Baseline * e.team.Scale,
+			WatermarkPenalty: e.team.Scale,
+			HighKeys:         make(map[Quartad]float64),
+			Info:             &KeyPenalty{Name: member.Username, Cost: member.Weight},
+		}
+	}
+	return e.team.objective(penalties), results
+}
+
+// printScores shows each member's penalty for a layout next to their penalty
+// on the starting layout.
+func (t *Team) printScores(layout Layout) {
+	layout = layout.Duplicate()
+	e := t.NewEvaluator(&layout)
+	p.Println("\nScores by user:")
+	for i, evaluator := range e.evaluators {
+		member := t.Members[i]
+		penalty, _ := evaluator.Results()
+		p.Printf("%16s: %d (%.1f%% of the starting layout, weight %.2g)\n",
+			member.Username, int(penalty), penalty/member.Baseline*100.0, member.Weight)
+	}
+}
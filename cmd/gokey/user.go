@@ -22,14 +22,19 @@ type Hand struct {
 }
 
 type User struct {
-	Name                     string   `json:"name"`
-	Keyboard                 string   `json:"keyboard"`
-	Corpus                   []string `json:"corpus"`
-	RawLocale                string   `json:"locale"`
-	RawRequired              string   `json:"required"`
-	BackspaceUsage           float64  `json:"backspace_usage"`
-	StartingPenaltyWatermark float64  `json:"starting_penalty_watermark"`
+	Name                     string         `json:"name"`
+	Keyboard                 string         `json:"keyboard"`
+	Corpus                   []CorpusSource `json:"corpus"`
+	RawLocale                string         `json:"locale"`
+	RawRequired              string         `json:"required"`
+	RawShortcuts             []string       `json:"shortcuts"`
+	Constraints              []Constraint   `json:"constraints"`
+	RawReference             string         `json:"reference"`
+	BackspaceUsage           float64        `json:"backspace_usage"`
+	StartingPenaltyWatermark float64        `json:"starting_penalty_watermark"`
 	Required                 []rune
+	Shortcuts                []Shortcut
+	Reference                map[rune]ReferenceKey `json:"-"`
 	Locale                   Locale
 	Layout                   Layout
 	Left                     Hand `json:"left"`
@@ -51,6 +56,11 @@ type User struct {
 		DiagonalModifier     float64 `json:"diagonal_modifier"`
 		ModifierStretch      float64 `json:"modifier_stretch"`
 		DoubleTapThumbs      float64 `json:"double_tap_thumbs"`
+		Combo                float64 `json:"combo"`
+		ComboClash           float64 `json:"combo_clash"`
+		MovedRune            float64 `json:"moved_rune"`
+		MovedFinger          float64 `json:"moved_finger"`
+		MovedHand            float64 `json:"moved_hand"`
 	} `json:"penalties"`
 }
 
@@ -68,6 +78,11 @@ func ReadUser(filename string) (User, error) {
 		return User{}, fmt.Errorf("error parsing JSON: %w", err)
 	}
 
+	// Check how the corpus files are blended
+	if _, _, err := corpusGroups(profile.Corpus); err != nil {
+		return User{}, err
+	}
+
 	// Get the required runes
 	profile.Required = make([]rune, 0)
 	for _, c := range profile.RawRequired {
@@ -75,12 +90,26 @@ func ReadUser(filename string) (User, error) {
 		profile.Required = append(profile.Required, r)
 	}
 
+	// Read the shortcuts they use
+	profile.Shortcuts, err = ReadShortcuts(profile.RawShortcuts)
+	if err != nil {
+		return User{}, err
+	}
+
 	// Now read their locale
 	profile.Locale, err = LoadUserLocale(profile.RawLocale)
 	if err != nil {
 		return User{}, err
 	}
 
+	// Read the keyboard they type on today
+	if profile.RawReference != "" {
+		profile.Reference, err = ReadReference(profile)
+		if err != nil {
+			return User{}, fmt.Errorf("error reading reference keyboard: %w", err)
+		}
+	}
+
 	// Now read their layout
 	if len(optLayout) > 0 {
 		profile.Keyboard = optLayout
@@ -89,6 +118,10 @@ func ReadUser(filename string) (User, error) {
 	if err != nil {
 		return User{}, err
 	}
+	if err := layout.validateConstraints(profile.Constraints); err != nil {
+		return User{}, err
+	}
+	layout.Constraints = profile.Constraints
 	profile.Layout = layout
 
 	return profile, nil
@@ -2,6 +2,7 @@ package main
 
 import (
 	"cmp"
+	"slices"
 )
 
 type KeyValue[K cmp.Ordered, V cmp.Ordered] struct {
@@ -9,11 +10,15 @@ type KeyValue[K cmp.Ordered, V cmp.Ordered] struct {
 	Value V
 }
 
-func randomizeMapToArray[K comparable, V any](m map[K]V) []K {
+func randomizeMapToArray[K cmp.Ordered, V any](m map[K]V) []K {
 	keys := make([]K, 0, len(m))
 	for k := range m {
 		keys = append(keys, k)
 	}
+	// Sort first so that the shuffle only depends on the random seed and not
+	// on map iteration order
+	slices.Sort(keys)
+
 	// Randomize the slice by shuffling it
 	return randomizeSlice(keys)
 }
@@ -43,6 +48,9 @@ func RuneDisplayVersion(r rune) rune {
 	if mappedRune, ok := specialCharMap[r]; ok {
 		return mappedRune
 	}
+	if layer, ok := isLayerRune(r); ok && layer <= 20 {
+		return '①' + rune(layer-1) // Layer keys are circled layer numbers
+	}
 
 	return r
 }
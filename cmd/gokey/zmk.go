@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/cobra"
+)
+
+var zmkCmd = &cobra.Command{
+	Use:   "zmk [username] [keyboard]",
+	Short: "Export a layout as a ZMK keymap.",
+	Long: `Export a fully specified keyboard layout as a ZMK devicetree keymap. The
+keyboard file must have a "zmk" section giving the order of the board's
+bindings. Key names assume the computer uses a US layout, with the user's
+locale saying which symbols need shift.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run:  exportZMK,
+}
+
+func init() {
+	exportCmd.AddCommand(zmkCmd)
+}
+
+// ZMK describes the bindings of a ZMK keyboard. Each entry in Keys is a key
+// position like "L2,3" or a ZMK binding for a key gokey doesn't model, with
+// one row of entries for each line of the bindings.
+type ZMK struct {
+	Keys [][]string `json:"keys"`
+}
+
+var zmkKeyNames = map[rune]string{
+	' ':  "SPACE",
+	'\n': "RET",
+	'\t': "TAB",
+	'\b': "BSPC",
+	'-':  "MINUS",
+	'=':  "EQUAL",
+	'[':  "LBKT",
+	']':  "RBKT",
+	'\\': "BSLH",
+	';':  "SEMI",
+	'\'': "SQT",
+	'`':  "GRAVE",
+	',':  "COMMA",
+	'.':  "DOT",
+	'/':  "FSLH",
+	'§':  "NON_US_BSLH",
+}
+
+// zmkModifiers gives the left and right key names of each modifier.
+var zmkModifiers = map[Modifier][2]string{
+	ShiftModifier: {"LSHFT", "RSHFT"},
+	CtrlModifier:  {"LCTRL", "RCTRL"},
+	AltModifier:   {"LALT", "RALT"},
+}
+
+func exportZMK(cmd *cobra.Command, args []string) {
+	user, err := readExportLayout(args)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	source, err := user.Layout.ZMKKeymap(user.Locale)
+	if err != nil {
+		p.Println(err)
+		return
+	}
+	if err := writeExport(source); err != nil {
+		p.Println(err)
+	}
+}
+
+// ZMKKeymap generates a .keymap with a ZMK layer for each layer and a ZMK
+// combo for each combo. Keys whose shifted rune isn't what shift normally
+// gives use mod-morph behaviors.
+func (layout *Layout) ZMKKeymap(locale Locale) (string, error) {
+	if layout.ZMK == nil {
+		return "", fmt.Errorf("keyboard %s has no zmk section", layout.Name)
+	}
+
+	var morphs []string
+	layers := make([][][]string, len(layout.Layers)+1)
+	for layer := range layers {
+		rows, err := layout.firmwareKeys(layout.ZMK.Keys, layer, "&trans", func(keyInfo *KeyPhysicalInfo) (string, error) {
+			binding, morph, err := layout.zmkBinding(keyInfo, locale)
+			if morph != "" {
+				morphs = append(morphs, morph)
+				binding = fmt.Sprintf("&mm_%d", len(morphs)-1)
+			}
+			return binding, err
+		})
+		if err != nil {
+			return "", err
+		}
+		layers[layer] = rows
+	}
+
+	// Combos refer to keys by their index in the bindings, which counts every
+	// entry including repeated ones like &none
+	indexes := make(map[string]int)
+	index := 0
+	for _, row := range layout.ZMK.Keys {
+		for _, entry := range row {
+			if isPosition(entry) {
+				indexes[entry] = index
+			}
+			index++
+		}
+	}
+	var combos [][2]string
+	for i := range layout.ComboKeys {
+		comboKey := &layout.ComboKeys[i]
+		if comboKey.key.UnshiftedIsFree {
+			continue
+		}
+		binding, morph, err := layout.zmkBinding(comboKey, locale)
+		if err != nil {
+			return "", err
+		}
+		if morph != "" {
+			morphs = append(morphs, morph)
+			binding = fmt.Sprintf("&mm_%d", len(morphs)-1)
+		}
+		var positions []string
+		for _, position := range layout.comboPositions(comboKey) {
+			index, ok := indexes[position]
+			if !ok {
+				return "", fmt.Errorf("combo key %s is not in the zmk section", position)
+			}
+			positions = append(positions, fmt.Sprint(index))
+		}
+		combos = append(combos, [2]string{strings.Join(positions, " "), binding})
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("// %s, generated by gokey\n", layout.Name))
+	sb.WriteString("#include <behaviors.dtsi>\n")
+	sb.WriteString("#include <dt-bindings/zmk/keys.h>\n\n")
+	sb.WriteString("/ {\n")
+	if len(morphs) > 0 {
+		sb.WriteString("    behaviors {\n")
+		for i, morph := range morphs {
+			sb.WriteString(fmt.Sprintf("        mm_%d: mm_%d {\n", i, i))
+			sb.WriteString("            compatible = \"zmk,behavior-mod-morph\";\n")
+			sb.WriteString("            #binding-cells = <0>;\n")
+			sb.WriteString(fmt.Sprintf("            bindings = %s;\n", morph))
+			sb.WriteString("            mods = <(MOD_LSFT|MOD_RSFT)>;\n")
+			sb.WriteString("        };\n")
+		}
+		sb.WriteString("    };\n\n")
+	}
+	if len(combos) > 0 {
+		sb.WriteString("    combos {\n")
+		sb.WriteString("        compatible = \"zmk,combos\";\n")
+		for i, combo := range combos {
+			sb.WriteString(fmt.Sprintf("        combo_%d {\n", i))
+			sb.WriteString(fmt.Sprintf("            key-positions = <%s>;\n", combo[0]))
+			sb.WriteString(fmt.Sprintf("            bindings = <%s>;\n", combo[1]))
+			sb.WriteString("        };\n")
+		}
+		sb.WriteString("    };\n\n")
+	}
+	sb.WriteString("    keymap {\n")
+	sb.WriteString("        compatible = \"zmk,keymap\";\n\n")
+	for layer, rows := range layers {
+		if layer > 0 {
+			sb.WriteString("\n")
+			sb.WriteString(fmt.Sprintf("        %s_layer {\n", zmkNodeName(layout.Layers[layer-1].Name)))
+		} else {
+			sb.WriteString("        default_layer {\n")
+		}
+		sb.WriteString("            bindings = <\n")
+		sb.WriteString(formatKeyRows(rows, "                ", ""))
+		sb.WriteString("            >;\n")
+		sb.WriteString("        };\n")
+	}
+	sb.WriteString("    };\n")
+	sb.WriteString("};\n")
+
+	return sb.String(), nil
+}
+
+// zmkBinding returns the binding for a key and, if shift doesn't give the
+// key's shifted rune, the bindings of a mod-morph producing it.
+func (layout *Layout) zmkBinding(keyInfo *KeyPhysicalInfo, locale Locale) (string, string, error) {
+	key := keyInfo.key
+	if key.UnshiftedIsFree || key.UnshiftedRune == 0 {
+		return "&none", "", nil
+	}
+	if layer, ok := isLayerRune(key.UnshiftedRune); ok {
+		switch layout.Layers[layer-1].Activation {
+		case Toggle:
+			return fmt.Sprintf("&tog %d", layer), "", nil
+		case OneShot:
+			return fmt.Sprintf("&sl %d", layer), "", nil
+		default:
+			return fmt.Sprintf("&mo %d", layer), "", nil
+		}
+	}
+	if modifier, ok := zmkModifiers[Modifier(key.UnshiftedRune)]; ok {
+		if layout.isLeftHand(keyInfo) {
+			return "&kp " + modifier[0], "", nil
+		}
+		return "&kp " + modifier[1], "", nil
+	}
+
+	name, shifted, err := zmkKeyName(key.UnshiftedRune, locale)
+	if err != nil {
+		return "", "", err
+	}
+	binding := "&kp " + name
+	if key.ShiftedIsFree || key.ShiftedRune == 0 || key.ShiftedRune == shifted || key.ShiftedRune == key.UnshiftedRune {
+		return binding, "", nil
+	}
+
+	shiftedName, _, err := zmkKeyName(key.ShiftedRune, locale)
+	if err != nil {
+		return "", "", err
+	}
+	return binding, fmt.Sprintf("<%s>, <&kp %s>", binding, shiftedName), nil
+}
+
+// zmkKeyName returns the ZMK key name that types a rune, and the rune typed
+// when shift is held with it.
+func zmkKeyName(r rune, locale Locale) (string, rune, error) {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return string(unicode.ToUpper(r)), unicode.ToUpper(r), nil
+	case r >= 'A' && r <= 'Z':
+		return fmt.Sprintf("LS(%c)", r), r, nil
+	case r >= '1' && r <= '9', r == '0':
+		return "N" + string(r), locale.unshiftedToShifted[r], nil
+	}
+	if name, ok := zmkKeyNames[r]; ok {
+		shifted, ok := locale.unshiftedToShifted[r]
+		if !ok {
+			shifted = r
+		}
+		return name, shifted, nil
+	}
+	if unshifted, ok := locale.shiftedToUnshifted[r]; ok {
+		name, _, err := zmkKeyName(unshifted, locale)
+		if err != nil {
+			return "", 0, err
+		}
+		return "LS(" + name + ")", r, nil
+	}
+	return "", 0, fmt.Errorf("no ZMK key name for %q", r)
+}
+
+var zmkNodeNameInvalid = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// zmkNodeName turns a layer name into a valid devicetree node name.
+func zmkNodeName(name string) string {
+	return zmkNodeNameInvalid.ReplaceAllString(strings.ToLower(name), "_")
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestZMKComboPositionsCountRepeatedBindings(t *testing.T) {
+	user := readTestUser(t, "crkbd")
+	layout := user.Layout
+	layout.ComboKeys[0].key = &Key{UnshiftedRune: 'x', ShiftedRune: 'X'}
+	layout.ComboKeys[1].key = &Key{UnshiftedIsFree: true, ShiftedIsFree: true}
+	layout.ZMK = &ZMK{Keys: [][]string{
+		{"&none", "L1,2", "&none"},
+		{"&trans", "L1,3", "&trans", "L1,4"},
+	}}
+
+	keymap, err := layout.ZMKKeymap(user.Locale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "key-positions = <4 6>;"; !strings.Contains(keymap, want) {
+		t.Errorf("keymap doesn't contain %q:\n%s", want, keymap)
+	}
+}